@@ -42,3 +42,17 @@ func (p jsonBodyProvider) Body() ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+// codecBodyProvider encodes the payload with a codec
+type codecBodyProvider struct {
+	codec   Codec
+	payload interface{}
+}
+
+func (p codecBodyProvider) ContentType() string {
+	return p.codec.ContentType()
+}
+
+func (p codecBodyProvider) Body() ([]byte, error) {
+	return p.codec.Marshal(p.payload)
+}
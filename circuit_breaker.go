@@ -0,0 +1,203 @@
+package titan
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	CircuitClosed   = "CLOSED"
+	CircuitOpen     = "OPEN"
+	CircuitHalfOpen = "HALF_OPEN"
+)
+
+// ErrCircuitOpen is returned without sending the request when the circuit of the destination subject is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerConfig configures the circuit breakers the client keeps per destination subject.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           // consecutive failures or timeouts which open the circuit
+	Cooldown         time.Duration // time the circuit stays open before a trial request is let through
+}
+
+func DefaultCircuitBreakerConfig() *CircuitBreakerConfig {
+	return &CircuitBreakerConfig{
+		FailureThreshold: 5,
+		Cooldown:         10 * time.Second,
+	}
+}
+
+// circuitBreakers are the breakers of a client and its copies, keyed by destination subject
+type circuitBreakers struct {
+	config    CircuitBreakerConfig
+	mux       sync.Mutex
+	bySubject map[string]*circuitBreaker
+}
+
+// circuitBreakersRef is held by a client and its copies. Once no client refers to it any more
+// its breakers are dropped from the monitoring, clients made per request or tenant do not pile up.
+type circuitBreakersRef struct {
+	*circuitBreakers
+}
+
+// the breakers of the live clients, for the monitoring
+var circuitBreakerSetsMux sync.Mutex
+var circuitBreakerSets = map[*circuitBreakers]struct{}{}
+
+type circuitBreaker struct {
+	config   CircuitBreakerConfig
+	mux      sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool // a half open trial request is in flight
+}
+
+func newCircuitBreakers(config *CircuitBreakerConfig) *circuitBreakersRef {
+	cbs := &circuitBreakers{config: *config, bySubject: map[string]*circuitBreaker{}}
+	circuitBreakerSetsMux.Lock()
+	circuitBreakerSets[cbs] = struct{}{}
+	circuitBreakerSetsMux.Unlock()
+
+	ref := &circuitBreakersRef{cbs}
+	runtime.SetFinalizer(ref, func(ref *circuitBreakersRef) {
+		circuitBreakerSetsMux.Lock()
+		defer circuitBreakerSetsMux.Unlock()
+		delete(circuitBreakerSets, ref.circuitBreakers)
+	})
+	return ref
+}
+
+func (cbs *circuitBreakers) get(subject string) *circuitBreaker {
+	cbs.mux.Lock()
+	defer cbs.mux.Unlock()
+	cb, ok := cbs.bySubject[subject]
+	if !ok {
+		cb = &circuitBreaker{config: cbs.config, state: CircuitClosed}
+		cbs.bySubject[subject] = cb
+	}
+	return cb
+}
+
+func (cbs *circuitBreakers) states(states map[string]string) {
+	cbs.mux.Lock()
+	defer cbs.mux.Unlock()
+	for subject, cb := range cbs.bySubject {
+		state := cb.State()
+		if circuitStateRank[state] > circuitStateRank[states[subject]] {
+			states[subject] = state
+		}
+	}
+}
+
+// a subject shows the worst state among the clients calling it
+var circuitStateRank = map[string]int{CircuitClosed: 1, CircuitHalfOpen: 2, CircuitOpen: 3}
+
+// CircuitBreakerStates returns the circuit state of every destination subject of all live clients,
+// e.g. {"api.service.test": "OPEN"}
+func CircuitBreakerStates() map[string]string {
+	circuitBreakerSetsMux.Lock()
+	defer circuitBreakerSetsMux.Unlock()
+	states := map[string]string{}
+	for cbs := range circuitBreakerSets {
+		cbs.states(states)
+	}
+	return states
+}
+
+// CircuitBreakerStates returns the circuit state of every destination subject of this client.
+func (srv *Client) CircuitBreakerStates() map[string]string {
+	states := map[string]string{}
+	if srv.circuitBreakers != nil {
+		srv.circuitBreakers.states(states)
+	}
+	return states
+}
+
+func (cb *circuitBreaker) State() string {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.config.Cooldown {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+// allow reports whether a request may be sent, after the cooldown only one trial request is let through
+func (cb *circuitBreaker) allow() bool {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	switch cb.state {
+	case CircuitClosed:
+		return true
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.config.Cooldown {
+			return false
+		}
+		cb.state = CircuitHalfOpen
+		cb.trial = true
+		return true
+	default: // half open
+		if cb.trial {
+			return false
+		}
+		cb.trial = true
+		return true
+	}
+}
+
+// release ends a trial request without a result, e.g. the caller gave up
+func (cb *circuitBreaker) release() {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.trial = false
+}
+
+func (cb *circuitBreaker) record(success bool) {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.trial = false
+	if success {
+		cb.state = CircuitClosed
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.config.FailureThreshold {
+		cb.state = CircuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// WithCircuitBreaker returns a client sharing the same connection which fails fast
+// with status 503 while the destination subject is unhealthy. Its breakers are its own,
+// copies made of it with WithRetryPolicy share them.
+func (srv *Client) WithCircuitBreaker(config *CircuitBreakerConfig) *Client {
+	c := *srv
+	c.circuitBreakers = newCircuitBreakers(config)
+	return &c
+}
+
+func (srv *Client) requestWithCircuitBreaker(ctx context.Context, rq *Request, subject string) (*Response, error) {
+	if srv.circuitBreakers == nil {
+		return srv.request(ctx, rq, subject)
+	}
+
+	cb := srv.circuitBreakers.get(subject)
+	if !cb.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	rp, err := srv.request(ctx, rq, subject)
+	// a caller which gave up says nothing about the health of the destination
+	if errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled) {
+		cb.release()
+		return rp, err
+	}
+	cb.record(err == nil && rp.StatusCode < 500)
+	return rp, err
+}
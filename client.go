@@ -2,6 +2,7 @@ package titan
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -16,7 +17,9 @@ import (
 )
 
 type Client struct {
-	conn IConnection
+	conn            IConnection
+	retryPolicy     *RetryPolicy
+	circuitBreakers *circuitBreakersRef
 }
 
 func NewClient(conn IConnection) *Client {
@@ -25,12 +28,31 @@ func NewClient(conn IConnection) *Client {
 
 var null = []byte{'n', 'u', 'l', 'l'}
 
-func (srv *Client) request(rq *Request, subject string) (*Response, error) {
+func (srv *Client) request(ctx context.Context, rq *Request, subject string) (*Response, error) {
 	defer func(c IConnection) {
 		_ = c.Flush()
 	}(srv.conn)
 
-	return srv.conn.SendRequest(rq, subject)
+	if c, ok := srv.conn.(ContextRequester); ok {
+		return c.SendRequestWithContext(ctx, rq, subject)
+	}
+
+	// the connection cannot abort the request, stop waiting for it when ctx is done
+	type result struct {
+		rp  *Response
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rp, err := srv.conn.SendRequest(rq, subject)
+		done <- result{rp, err}
+	}()
+	select {
+	case r := <-done:
+		return r.rp, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func (srv *Client) SendAndReceiveJson(ctx *Context, rq *Request, receive interface{}) error {
@@ -105,9 +127,9 @@ func (srv *Client) SendAndReceiveJson(ctx *Context, rq *Request, receive interfa
 		ptr := receive.(*bool)
 		*ptr = result
 	default:
-		err := json.Unmarshal(msg.Body, &receive)
+		err := requestCodec(msg.Headers).Unmarshal(msg.Body, receive)
 		if err != nil {
-			return errors.WithMessage(err, "nats client json parsing error")
+			return errors.WithMessage(err, "nats client body parsing error")
 		}
 	}
 	return nil
@@ -124,13 +146,15 @@ func cleanString(str []byte) string {
 	return s
 }
 
-func (srv *Client) SendRequest(ctx *Context, rq *Request) (*Response, error) {
-	t := time.Now()
-	logger := ctx.Logger()
+// setRequestHeaders copies the contextual metadata into the request headers and returns the request id
+func setRequestHeaders(ctx *Context, rq *Request) string {
+	if rq.Headers == nil {
+		rq.Headers = http.Header{}
+	}
 
 	// build request id
 	requestId := ctx.RequestId()
-	if requestId == "" && rq.Headers != nil {
+	if requestId == "" {
 		requestId = rq.Headers.Get(XRequestId)
 	}
 
@@ -140,14 +164,42 @@ func (srv *Client) SendRequest(ctx *Context, rq *Request) (*Response, error) {
 	rq.Headers.Set(XRequestId, requestId)
 
 	origin := ctx.Origin()
-	if origin == "" && rq.Headers != nil {
+	if origin == "" {
 		origin = rq.Headers.Get(XOrigin)
 	}
 
 	rq.Headers.Set(XOrigin, origin)
 
+	// retries and redeliveries of the caller repeat the calls it makes with the same keys
+	if rq.Headers.Get(XIdempotencyKey) == "" {
+		if key := callIdempotencyKey(ctx, rq.Method+" "+rq.URL); key != "" {
+			rq.Headers.Set(XIdempotencyKey, key)
+		}
+	}
+
 	rq.Headers.Set(XRequestTime, strconv.FormatInt(time.Now().UnixNano(), 10))
 
+	//todo: copy authentication here
+	userInfoJson := ctx.UserInfoJson()
+	if userInfoJson != "" {
+		rq.Headers.Set(XUserInfo, userInfoJson)
+	}
+	return requestId
+}
+
+func (srv *Client) SendRequest(ctx *Context, rq *Request) (*Response, error) {
+	t := time.Now()
+	logger := ctx.Logger()
+
+	requestId := setRequestHeaders(ctx, rq)
+
+	var reqCtx context.Context = ctx
+	if rq.Timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, rq.Timeout)
+		defer cancel()
+	}
+
 	uberTraceID := ctx.UberTraceID()
 	rq.Headers.Set(UberTraceID, uberTraceID)
 	reqSpan := tracing.SpanContext(&rq.Headers, rq.URL)
@@ -155,12 +207,6 @@ func (srv *Client) SendRequest(ctx *Context, rq *Request) (*Response, error) {
 		defer reqSpan.Finish()
 	}
 
-	//todo: copy authentication here
-	userInfoJson := ctx.UserInfoJson()
-	if userInfoJson != "" {
-		rq.Headers.Set(XUserInfo, ctx.UserInfoJson())
-	}
-
 	// end of hacked code
 	subject := rq.Subject
 	if rq.Subject == "" {
@@ -168,16 +214,19 @@ func (srv *Client) SendRequest(ctx *Context, rq *Request) (*Response, error) {
 	}
 
 	logger.Debug("Nats client sending request to", map[string]interface{}{"url": rq.URL, "id": requestId, "method": rq.Method})
-	rp, err := srv.request(rq, subject)
+	rp, err := srv.requestWithRetry(reqCtx, logger, rq, subject)
 
 	// just log event
 	defer func(e error) {
+		observeClientRequest(subject, rq.Method, rp, e, time.Since(t))
 		elapsedMs := float64(time.Since(t).Nanoseconds()) / 1000000.0
 		logInfo := map[string]interface{}{
 			"id":         requestId,
 			"url":        rq.URL,
 			"elapsed_ms": elapsedMs,
-			"status":     fmt.Sprintf("%d", rp.StatusCode),
+		}
+		if rp != nil {
+			logInfo["status"] = fmt.Sprintf("%d", rp.StatusCode)
 		}
 
 		if e != nil {
@@ -199,16 +248,7 @@ func (srv *Client) SendRequest(ctx *Context, rq *Request) (*Response, error) {
 
 	// server return error object
 	if err != nil {
-		var rpErr *Response
-		headers := http.Header{}
-		headers.Add(XRequestId, requestId)
-
-		if err.Error() == "nats: timeout" {
-			rpErr = &Response{Status: "Request Timeout :" + requestId, StatusCode: 408, Headers: headers}
-		} else {
-			rpErr = &Response{Status: "Internal Server Error: " + requestId, StatusCode: 500, Headers: headers}
-		}
-		return nil, &ClientResponseError{Message: err.Error(), Response: rpErr, Cause: err}
+		return nil, transportError(requestId, err)
 	}
 
 	// server return status code
@@ -219,16 +259,8 @@ func (srv *Client) SendRequest(ctx *Context, rq *Request) (*Response, error) {
 		rp.Headers.Add(XRequestId, requestId)
 	}
 
-	if rp.StatusCode >= 400 {
-		return nil, &ClientResponseError{Message: rp.Status, Response: rp}
-	}
-
-	if rp.StatusCode >= 300 {
-		return nil, &ClientResponseError{Message: "HTTP 3xx Redirection was not implemented yet", Response: rp}
-	}
-
-	if rp.StatusCode < 200 {
-		return nil, &ClientResponseError{Message: "HTTP 1xx Informational response was not implemented yet", Response: rp}
+	if err := statusError(rp); err != nil {
+		return nil, err
 	}
 
 	// log  too high latency
@@ -250,7 +282,61 @@ func (srv *Client) SendRequest(ctx *Context, rq *Request) (*Response, error) {
 	return rp, nil
 }
 
+// transportError wraps an error which prevented getting any response from the server
+func transportError(requestId string, err error) *ClientResponseError {
+	var rpErr *Response
+	headers := http.Header{}
+	headers.Add(XRequestId, requestId)
+
+	switch errorStatusCode(err) {
+	case 408:
+		rpErr = &Response{Status: "Request Timeout :" + requestId, StatusCode: 408, Headers: headers}
+	case 503:
+		rpErr = &Response{Status: "Service Unavailable :" + requestId, StatusCode: 503, Headers: headers}
+	default:
+		rpErr = &Response{Status: "Internal Server Error: " + requestId, StatusCode: 500, Headers: headers}
+	}
+	return &ClientResponseError{Message: err.Error(), Response: rpErr, Cause: err}
+}
+
+// statusError returns an error for responses other than 2xx
+func statusError(rp *Response) error {
+	if rp.StatusCode >= 400 {
+		return &ClientResponseError{Message: rp.Status, Response: rp}
+	}
+
+	if rp.StatusCode >= 300 {
+		return &ClientResponseError{Message: "HTTP 3xx Redirection was not implemented yet", Response: rp}
+	}
+
+	if rp.StatusCode < 200 {
+		return &ClientResponseError{Message: "HTTP 1xx Informational response was not implemented yet", Response: rp}
+	}
+	return nil
+}
+
 func (srv *Client) Publish(ctx *Context, subject string, body interface{}) error {
+	return srv.publish(ctx, subject, body, func(m *Message) error {
+		return srv.conn.Publish(subject, m)
+	})
+}
+
+// PublishPersistent stores the message in the JetStream stream bound to the subject, so that durable
+// subscribers receive it even when they are down right now. It returns the sequence number of the message.
+func (srv *Client) PublishPersistent(ctx *Context, subject string, body interface{}) (uint64, error) {
+	var seq uint64
+	p, ok := srv.conn.(PersistentPublisher)
+	if !ok {
+		return 0, errNotSupported(srv.conn, "persistent publish")
+	}
+	err := srv.publish(ctx, subject, body, func(m *Message) (err error) {
+		seq, err = p.PublishPersistent(subject, m)
+		return err
+	})
+	return seq, err
+}
+
+func (srv *Client) publish(ctx *Context, subject string, body interface{}, send func(m *Message) error) error {
 	m := Message{
 		Headers: http.Header{},
 	}
@@ -258,6 +344,9 @@ func (srv *Client) Publish(ctx *Context, subject string, body interface{}) error
 	m.Headers.Set(XRequestId, ctx.RequestId())
 	m.Headers.Set(XOrigin, ctx.Origin())
 	m.Headers.Set(XUserInfo, ctx.UserInfoJson())
+	if key := callIdempotencyKey(ctx, subject); key != "" {
+		m.Headers.Set(XIdempotencyKey, key)
+	}
 
 	m.Headers.Set(UberTraceID, ctx.UberTraceID())
 	uberTraceID := ctx.UberTraceID()
@@ -273,7 +362,7 @@ func (srv *Client) Publish(ctx *Context, subject string, body interface{}) error
 	}
 	m.Body = b
 
-	return srv.conn.Publish(subject, m)
+	return send(&m)
 }
 
 func (srv *Client) Subscribe(subject string, cb Handler) (ISubscription, error) {
@@ -0,0 +1,177 @@
+package titan_test
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/silenteer-oss/titan"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var requestIds []string
+	conn := titan.NewMemoryConnection(func(r titan.Router) {
+		r.RegisterJson("GET", "/api/service/test/flaky", func(c *titan.Context) (*titan.Response, error) {
+			requestIds = append(requestIds, c.RequestId())
+			if len(requestIds) < 3 {
+				return titan.NewResBuilder().StatusCode(503).Build(), nil
+			}
+			return titan.NewResBuilder().Build(), nil
+		})
+		r.RegisterJson("POST", "/api/service/test/flaky", func(c *titan.Context) (*titan.Response, error) {
+			requestIds = append(requestIds, c.RequestId())
+			return titan.NewResBuilder().StatusCode(503).Build(), nil
+		})
+	})
+	policy := titan.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	client := titan.NewClient(conn).WithRetryPolicy(policy)
+
+	//1. idempotent request is retried with the same request id
+	request, _ := titan.NewReqBuilder().Get("/api/service/test/flaky").Build()
+	_, err := client.SendRequest(titan.NewBackgroundContext(), request)
+	require.NoError(t, err)
+	require.Len(t, requestIds, 3)
+	assert.Equal(t, requestIds[0], requestIds[1])
+	assert.Equal(t, requestIds[0], requestIds[2])
+
+	//2. non idempotent request is not retried
+	requestIds = nil
+	request, _ = titan.NewReqBuilder().Post("/api/service/test/flaky").Build()
+	_, err = client.SendRequest(titan.NewBackgroundContext(), request)
+	require.Error(t, err)
+	assert.Len(t, requestIds, 1)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	calls := 0
+	healthy := false
+	conn := titan.NewMemoryConnection(func(r titan.Router) {
+		r.RegisterJson("GET", "/api/service/breaker/get", func(c *titan.Context) (*titan.Response, error) {
+			calls++
+			if !healthy {
+				return titan.NewResBuilder().StatusCode(500).Build(), nil
+			}
+			return titan.NewResBuilder().Build(), nil
+		})
+	})
+	client := titan.NewClient(conn).WithCircuitBreaker(&titan.CircuitBreakerConfig{FailureThreshold: 2, Cooldown: 50 * time.Millisecond})
+	send := func() error {
+		request, _ := titan.NewReqBuilder().Get("/api/service/breaker/get").Build()
+		_, err := client.SendRequest(titan.NewBackgroundContext(), request)
+		return err
+	}
+
+	//1. circuit opens after two failures and fails fast
+	require.Error(t, send())
+	require.Error(t, send())
+	err := send()
+	require.IsType(t, &titan.ClientResponseError{}, err)
+	assert.Equal(t, 503, err.(*titan.ClientResponseError).Response.StatusCode)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, titan.CircuitOpen, titan.CircuitBreakerStates()["api.service.breaker"])
+
+	//2. a trial request closes the circuit again after the cooldown
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, titan.CircuitHalfOpen, titan.CircuitBreakerStates()["api.service.breaker"])
+	healthy = true
+	require.NoError(t, send())
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, titan.CircuitClosed, titan.CircuitBreakerStates()["api.service.breaker"])
+
+	//3. another client has its own breakers and config
+	other := titan.NewClient(conn).WithCircuitBreaker(&titan.CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Minute})
+	healthy = false
+	request, _ := titan.NewReqBuilder().Get("/api/service/breaker/get").Build()
+	_, err = other.SendRequest(titan.NewBackgroundContext(), request)
+	require.Error(t, err)
+	assert.Equal(t, titan.CircuitOpen, other.CircuitBreakerStates()["api.service.breaker"])
+	assert.Equal(t, titan.CircuitClosed, client.CircuitBreakerStates()["api.service.breaker"])
+	assert.Equal(t, titan.CircuitOpen, titan.CircuitBreakerStates()["api.service.breaker"])
+
+	//4. a caller giving up is not a failure of the destination
+	canceling := titan.NewClient(conn).WithCircuitBreaker(&titan.CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request, _ = titan.NewReqBuilder().Get("/api/service/breaker/get").Build()
+	_, err = canceling.SendRequest(titan.NewContext(ctx), request)
+	require.Error(t, err)
+	assert.Equal(t, titan.CircuitClosed, canceling.CircuitBreakerStates()["api.service.breaker"])
+
+	//5. the breakers of clients which are gone are not reported any more
+	func() {
+		gone := titan.NewClient(conn).WithCircuitBreaker(&titan.CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Minute})
+		request, _ := titan.NewReqBuilder().Get("/api/service/gone/get").Build()
+		_, _ = gone.SendRequest(titan.NewBackgroundContext(), request)
+		require.Contains(t, titan.CircuitBreakerStates(), "api.service.gone")
+	}()
+	assert.Eventually(t, func() bool {
+		runtime.GC()
+		_, ok := titan.CircuitBreakerStates()["api.service.gone"]
+		return !ok
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+// basicConnection hides the optional features of the wrapped connection
+type basicConnection struct {
+	titan.IConnection
+}
+
+func TestOptionalConnectionFeatures(t *testing.T) {
+	conn := titan.NewMemoryConnection(func(r titan.Router) {
+		r.RegisterJson("GET", "/api/service/test/basic", func(c *titan.Context) (*titan.Response, error) {
+			return titan.NewResBuilder().Build(), nil
+		})
+		r.RegisterJson("GET", "/api/service/test/slow", func(c *titan.Context) (*titan.Response, error) {
+			time.Sleep(time.Second)
+			return titan.NewResBuilder().Build(), nil
+		})
+	})
+	client := titan.NewClient(&basicConnection{conn})
+
+	//1. requests only need the basic connection, the client stops waiting at the timeout
+	request, _ := titan.NewReqBuilder().Get("/api/service/test/basic").Build()
+	_, err := client.SendRequest(titan.NewBackgroundContext(), request)
+	require.NoError(t, err)
+
+	request, _ = titan.NewReqBuilder().Get("/api/service/test/slow").Timeout(50 * time.Millisecond).Build()
+	_, err = client.SendRequest(titan.NewBackgroundContext(), request)
+	require.IsType(t, &titan.ClientResponseError{}, err)
+	assert.Equal(t, 408, err.(*titan.ClientResponseError).Response.StatusCode)
+
+	//2. optional features fail
+	request, _ = titan.NewReqBuilder().Get("/api/service/test/basic").Build()
+	_, err = client.SendStreamRequest(titan.NewBackgroundContext(), request)
+	assert.Error(t, err)
+	_, err = client.PublishPersistent(titan.NewBackgroundContext(), "test.persistent", "message")
+	assert.Error(t, err)
+}
+
+func TestMemoryConnectionPublish(t *testing.T) {
+	conn := titan.NewMemoryConnection()
+	client := titan.NewClient(conn)
+
+	//1. a subscriber failing to decode the message does not keep it from the others
+	var received []string
+	for i := 0; i < 2; i++ {
+		_, err := conn.Subscribe("test.memory", func(m *titan.Message) {
+			received = append(received, m.Subject)
+		})
+		require.NoError(t, err)
+		_, err = conn.Subscribe("test.memory", func(count *int) {})
+		require.NoError(t, err)
+	}
+	err := client.Publish(titan.NewBackgroundContext(), "test.memory", "message")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2 of 4 subscriptions")
+	assert.Equal(t, []string{"test.memory", "test.memory"}, received)
+
+	//2. message requests are reported as not supported
+	err = client.RequestMessage(titan.NewBackgroundContext(), "test.memory", "message", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not support message requests")
+}
@@ -0,0 +1,176 @@
+package titan
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	protobufContentType = "application/x-protobuf"
+	msgpackContentType  = "application/x-msgpack"
+)
+
+// Codec encodes request and response bodies of one content type.
+// A codec which can encode plain structs can also encode the NATS envelope, see Nats.Codec.
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+	MsgpackCodec  Codec = msgpackCodec{}
+)
+
+var codecsMux sync.RWMutex
+var codecs = map[string]Codec{}
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(ProtobufCodec, "application/protobuf")
+	RegisterCodec(MsgpackCodec, "application/msgpack", "application/vnd.msgpack")
+}
+
+// RegisterCodec makes the codec available for its content type and the given aliases,
+// and as NATS encoder under its content type.
+func RegisterCodec(codec Codec, aliases ...string) {
+	codecsMux.Lock()
+	defer codecsMux.Unlock()
+	codecs[codec.ContentType()] = codec
+	for _, alias := range aliases {
+		codecs[alias] = codec
+	}
+	nats.RegisterEncoder(codec.ContentType(), &natsEncoder{codec: codec})
+}
+
+// GetCodec returns the codec registered for the content type, parameters like charset are ignored
+func GetCodec(contentType string) (Codec, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	codecsMux.RLock()
+	defer codecsMux.RUnlock()
+	codec, ok := codecs[mediaType]
+	return codec, ok
+}
+
+// requestCodec decodes request bodies by their Content-Type, JSON by default
+func requestCodec(headers http.Header) Codec {
+	if codec, ok := GetCodec(headers.Get(contentType)); ok {
+		return codec
+	}
+	return JSONCodec
+}
+
+// responseCodec encodes handler results with the first supported type of the Accept header,
+// the request Content-Type otherwise.
+func responseCodec(headers http.Header) Codec {
+	for _, accept := range strings.Split(headers.Get("Accept"), ",") {
+		if codec, ok := GetCodec(strings.TrimSpace(accept)); ok {
+			return codec
+		}
+	}
+	return requestCodec(headers)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return jsonContentType
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// protobufCodec encodes generated protobuf messages only
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return protobufContentType
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.Errorf("protobuf codec cannot marshal %T, it is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errors.Errorf("protobuf codec cannot unmarshal into %T, it is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// msgpackCodec uses the json struct tags, so the same structs serve both codecs
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return msgpackContentType
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// natsEncoder encodes the Request/Response/Message envelope of an EncodedConn with a codec,
+// raw []byte and string values are passed through like nats.DefaultEncoder does.
+type natsEncoder struct {
+	codec Codec
+}
+
+func (e *natsEncoder) Encode(subject string, v interface{}) ([]byte, error) {
+	switch arg := v.(type) {
+	case []byte:
+		return arg, nil
+	case string:
+		return []byte(arg), nil
+	default:
+		return e.codec.Marshal(v)
+	}
+}
+
+func (e *natsEncoder) Decode(subject string, data []byte, vPtr interface{}) error {
+	switch arg := vPtr.(type) {
+	case *[]byte:
+		*arg = append([]byte(nil), data...)
+		return nil
+	case *string:
+		*arg = string(data)
+		return nil
+	default:
+		return e.codec.Unmarshal(data, vPtr)
+	}
+}
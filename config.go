@@ -33,8 +33,15 @@ var loggerOnce sync.Once
 var logger logur.Logger
 
 const (
-	NatsServers     = "Nats.Servers"
-	NatsReadTimeout = "Nats.ReadTimeout"
+	NatsServers         = "Nats.Servers"
+	NatsReadTimeout     = "Nats.ReadTimeout"
+	NatsCodec           = "Nats.Codec"           // content type of the codec encoding the request/response envelope
+	NatsEnvelope        = "Nats.Envelope"        // json or binary, see BinarySubject
+	NatsMessageEnvelope = "Nats.MessageEnvelope" // json or binary, switch once all subscribers decode binary
+	// requests a server handles at the same time, 0 is unlimited
+	NatsMaxConcurrency = "Nats.MaxConcurrency"
+	// seconds a stopping server waits for in-flight requests
+	NatsDrainTimeout = "Nats.DrainTimeout"
 
 	// see https://docs.nats.io/developing-with-nats/connecting/pingpong
 	NatsPingInterval        = "Nats.PingInterval"
@@ -44,6 +51,9 @@ const (
 	NatsPendingLimitByte = "Nats.PendingLimitByte"
 	NatsPendingLimitMsg  = "Nats.PendingLimitMsg"
 
+	// port of the standalone metrics endpoint of NATS servers, disabled when empty
+	MetricsPort = "Metrics.Port"
+
 	LoggingFormat  = "Logging.Format"
 	LoggingLevel   = "Logging.Level"
 	LoggingNoColor = "Logging.NoColor"
@@ -74,17 +84,30 @@ func init() {
 	// nats
 	viper.SetDefault(NatsServers, "nats://127.0.0.1:4222, nats://localhost:4222")
 	viper.SetDefault(NatsReadTimeout, 99999)
+	viper.SetDefault(NatsCodec, jsonContentType)
+	viper.SetDefault(NatsEnvelope, EnvelopeJSON)
+	viper.SetDefault(NatsMessageEnvelope, EnvelopeJSON)
+	viper.SetDefault(NatsMaxConcurrency, 100)
+	viper.SetDefault(NatsDrainTimeout, 15)
 	// see https://docs.nats.io/developing-with-nats/connecting/pingpong
 	viper.SetDefault(NatsPingInterval, 20)
 	viper.SetDefault(NatsMaxPingsOutstanding, 10)
-	viper.SetDefault(NatsPendingLimitByte, -1)
-	viper.SetDefault(NatsPendingLimitMsg, -1)
+	// bound the requests waiting for a free handler, see MaxConcurrency
+	viper.SetDefault(NatsPendingLimitByte, 64*1024*1024)
+	viper.SetDefault(NatsPendingLimitMsg, 65536)
+
+	viper.SetDefault(MetricsPort, "")
 
 }
 
 type NatsConfig struct {
 	Servers             string
 	ReadTimeout         int
+	Codec               string
+	Envelope            string
+	MessageEnvelope     string
+	MaxConcurrency      int
+	DrainTimeout        int
 	PingInterval        int
 	MaxPingsOutstanding int
 	PendingLimitMsg     int
@@ -95,11 +118,20 @@ func (c NatsConfig) GetReadTimeoutDuration() time.Duration {
 	return time.Duration(c.ReadTimeout) * time.Second
 }
 
+func (c NatsConfig) GetDrainTimeoutDuration() time.Duration {
+	return time.Duration(c.DrainTimeout) * time.Second
+}
+
 func GetNatsConfig() *NatsConfig {
 	natConfigOnce.Do(func() { // <-- atomic, does not allow repeating
 		natConfig = &NatsConfig{
 			Servers:             viper.GetString(NatsServers),
 			ReadTimeout:         viper.GetInt(NatsReadTimeout),
+			Codec:               viper.GetString(NatsCodec),
+			Envelope:            viper.GetString(NatsEnvelope),
+			MessageEnvelope:     viper.GetString(NatsMessageEnvelope),
+			MaxConcurrency:      viper.GetInt(NatsMaxConcurrency),
+			DrainTimeout:        viper.GetInt(NatsDrainTimeout),
 			PingInterval:        viper.GetInt(NatsPingInterval),
 			MaxPingsOutstanding: viper.GetInt(NatsMaxPingsOutstanding),
 			PendingLimitMsg:     viper.GetInt(NatsPendingLimitMsg),
@@ -127,6 +159,19 @@ func GetLogger() logur.Logger {
 	return logger
 }
 
+// SetNatsServers points the shared NatsConfig at other NATS servers, e.g. an embedded test server.
+// The cached default client is closed so that the next GetDefaultClient call reconnects.
+func SetNatsServers(servers string) {
+	config := GetNatsConfig()
+	mux.Lock()
+	defer mux.Unlock()
+	config.Servers = servers
+	if defaultClient != nil {
+		defaultClient.conn.Close()
+		defaultClient = nil
+	}
+}
+
 func GetDefaultClient() *Client {
 	if defaultClient != nil {
 		return defaultClient
@@ -173,7 +218,7 @@ func GetDefaultClient() *Client {
 		conn.Conn.Close()
 	}()
 
-	defaultClient = &Client{conn}
+	defaultClient = &Client{conn: conn}
 	mux.Unlock()
 
 	return defaultClient
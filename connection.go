@@ -1,6 +1,10 @@
 package titan
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,6 +21,38 @@ type IConnection interface {
 	Subscribe(subject string, cb Handler) (ISubscription, error)
 }
 
+// Optional features of an IConnection, the Client checks for them and fails the calls which need a missing one.
+// Connection and MemoryConnection implement all of them.
+
+// ContextRequester aborts in-flight requests when ctx is done, other connections are only abandoned by the Client.
+type ContextRequester interface {
+	SendRequestWithContext(ctx context.Context, rq *Request, subject string) (*Response, error)
+}
+
+type ScatterGatherer interface {
+	ScatterGather(ctx context.Context, rq *Request, subject string, maxReplies int) ([]*Response, error)
+}
+
+type StreamRequester interface {
+	SendStreamRequest(ctx context.Context, rq *Request, subject string) (*ResponseStream, error)
+}
+
+type UploadRequester interface {
+	SendUploadRequest(ctx context.Context, rq *Request, subject string, body io.Reader) (*Response, error)
+}
+
+type PersistentPublisher interface {
+	PublishPersistent(subject string, m *Message) (uint64, error)
+}
+
+type MessageRequester interface {
+	RequestMessage(ctx context.Context, subject string, m *Message) (*Message, error)
+}
+
+func errNotSupported(conn IConnection, feature string) error {
+	return errors.Errorf("%T does not support %s", conn, feature)
+}
+
 type ISubscription interface {
 	Unsubscribe() error
 	Drain() error
@@ -24,10 +60,23 @@ type ISubscription interface {
 }
 
 type Connection struct {
-	Conn *nats.EncodedConn
+	Conn         *nats.EncodedConn
+	jsonFallback sync.Map // subject -> time until which requests are sent as JSON, see sendBinaryRequest
 }
 
 func (c *Connection) Subscribe(subject string, cb Handler) (ISubscription, error) {
+	// messages may come in either envelope
+	if h, ok := cb.(func(*Message)); ok {
+		return c.Conn.Conn.Subscribe(subject, func(msg *nats.Msg) {
+			m, err := decodeMessage(c.Conn, msg)
+			if err != nil {
+				GetLogger().Error(fmt.Sprintf("Nats message decoding error: %+v\n ", err))
+				return
+			}
+			m.Subject = msg.Subject
+			h(m)
+		})
+	}
 	return c.Conn.QueueSubscribe(subject, "", cb)
 }
 
@@ -46,25 +95,151 @@ func NewConnection(url string, options ...nats.Option) (*Connection, error) {
 		return nil, errors.WithMessage(err, "Error connecting to NATS")
 	}
 
-	enc, err := nats.NewEncodedConn(conn, nats.JSON_ENCODER)
+	encType := GetNatsConfig().Codec
+	if encType == jsonContentType {
+		encType = nats.JSON_ENCODER
+	}
+	enc, err := nats.NewEncodedConn(conn, encType)
 	if err != nil {
-		return nil, errors.WithMessage(err, "Cannot construct JSON encoded connection to NATS")
+		return nil, errors.WithMessage(err, "Cannot construct encoded connection to NATS")
 	}
 
 	return &Connection{Conn: enc}, nil
 }
 
 func (c *Connection) SendRequest(rq *Request, subject string) (*Response, error) {
+	return c.SendRequestWithContext(context.Background(), rq, subject)
+}
+
+// SendRequestWithContext aborts the in-flight request when ctx is done.
+// Without a deadline on ctx the request falls back to Nats.ReadTimeout.
+func (c *Connection) SendRequestWithContext(ctx context.Context, rq *Request, subject string) (*Response, error) {
+	if subject == "" {
+		return nil, errors.New("nats subject cannot be nil")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, GetNatsConfig().GetReadTimeoutDuration()+5*time.Second)
+		defer cancel()
+	}
+	if useBinaryEnvelope(c.Conn.Conn) {
+		rp, err := c.sendBinaryRequest(ctx, rq, subject)
+		if err != nats.ErrNoResponders {
+			return rp, err
+		}
+	}
+	msg, err := encodeMsg(c.Conn, subject, "", rq, rq.Headers)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.Conn.Conn.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(c.Conn, reply)
+}
+
+// ScatterGather publishes the request with a unique inbox and collects replies until
+// maxReplies (0 means unlimited) is reached or ctx is done.
+func (c *Connection) ScatterGather(ctx context.Context, rq *Request, subject string, maxReplies int) ([]*Response, error) {
 	if subject == "" {
 		return nil, errors.New("nats subject cannot be nil")
 	}
-	rp := Response{}
-	err := c.Conn.Request(subject, rq, &rp, GetNatsConfig().GetReadTimeoutDuration()+5*time.Second)
-	return &rp, err
+	inbox := nats.NewInbox()
+	sub, err := c.Conn.Conn.SubscribeSync(inbox)
+	if err != nil {
+		return nil, errors.WithMessage(err, "nats inbox subscription error")
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	msg, err := encodeMsg(c.Conn, subject, inbox, rq, rq.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Conn.Conn.PublishMsg(msg); err != nil {
+		return nil, errors.WithMessage(err, "nats scatter publish error")
+	}
+
+	var responses []*Response
+	for maxReplies <= 0 || len(responses) < maxReplies {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return responses, err
+		}
+		rp := &Response{}
+		if err := c.Conn.Enc.Decode(msg.Subject, msg.Data, rp); err != nil {
+			return responses, errors.WithMessage(err, "nats scatter reply decoding error")
+		}
+		responses = append(responses, rp)
+	}
+	return responses, nil
 }
 
+// Publish sends messages as JSON unless Nats.MessageEnvelope is binary, all subscribers must understand it then.
 func (c *Connection) Publish(subject string, v interface{}) error {
-	return c.Conn.Publish(subject, v)
+	var m *Message
+	switch msg := v.(type) {
+	case Message:
+		m = &msg
+	case *Message:
+		m = msg
+	default:
+		return c.Conn.Publish(subject, v)
+	}
+
+	msg, err := newMessageMsg(c.Conn, subject, m)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Conn.PublishMsg(msg)
+}
+
+// PublishPersistent stores the message in the JetStream stream bound to the subject
+// and returns its sequence number in the stream.
+func (c *Connection) PublishPersistent(subject string, m *Message) (uint64, error) {
+	js, err := c.Conn.Conn.JetStream()
+	if err != nil {
+		return 0, errors.WithMessage(err, "nats jetstream error")
+	}
+	msg, err := newMessageMsg(c.Conn, subject, m)
+	if err != nil {
+		return 0, err
+	}
+	ack, err := js.PublishMsg(msg)
+	if err != nil {
+		return 0, errors.WithMessage(err, "nats persistent publish error")
+	}
+	return ack.Sequence, nil
+}
+
+// RequestMessage sends the message to a reply handler and returns its reply.
+// Without a deadline on ctx the request falls back to Nats.ReadTimeout.
+func (c *Connection) RequestMessage(ctx context.Context, subject string, m *Message) (*Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, GetNatsConfig().GetReadTimeoutDuration()+5*time.Second)
+		defer cancel()
+	}
+	msg, err := newMessageMsg(c.Conn, subject, m)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.Conn.Conn.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessage(c.Conn, reply)
+}
+
+// newMessageMsg encodes the message in the configured message envelope
+func newMessageMsg(enc *nats.EncodedConn, subject string, m *Message) (*nats.Msg, error) {
+	if useBinaryMessageEnvelope(enc.Conn) {
+		return encodeMessage(subject, m), nil
+	}
+	return encodeMsg(enc, subject, "", m, m.Headers)
 }
 
 func (c *Connection) Flush() error {
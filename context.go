@@ -14,6 +14,7 @@ import (
 
 type QueryParams map[string][]string
 type PathParams map[string]string
+type SubjectParams map[string]string // named tokens of a message subject template
 
 type Context struct {
 	context            context.Context
@@ -108,6 +109,20 @@ func (c *Context) Origin() string {
 	return origin
 }
 
+// IdempotencyKey is the Idempotency-Key of the request or message being handled,
+// the requests and messages sent with the context get a key derived from it.
+func (c *Context) IdempotencyKey() string {
+	key, _ := c.Value(XIdempotencyKey).(string)
+	return key
+}
+
+// WithIdempotentCall names the requests and messages sent with the returned context, their Idempotency-Key is
+// derived from the name instead of their order, e.g. for calls to the same target made concurrently.
+// The name must be unique among the calls of the request being handled.
+func (c *Context) WithIdempotentCall(name string) *Context {
+	return c.WithValue(idempotentCall, name)
+}
+
 func (c *Context) UberTraceID() string {
 	id, ok := c.Value(UberTraceID).(string)
 	if !ok {
@@ -136,6 +151,20 @@ func (c *Context) GetPathParam(name string) string {
 	return c.PathParams()[name]
 }
 
+// SubjectParams are the named tokens of the subject template a message handler is registered with,
+// e.g. cpId of events.careprovider.{cpId}.patient.>
+func (c *Context) SubjectParams() SubjectParams {
+	subjectParams, ok := c.Value(XSubjectParams).(SubjectParams)
+	if !ok {
+		subjectParams = SubjectParams{}
+	}
+	return subjectParams
+}
+
+func (c *Context) GetSubjectParam(name string) string {
+	return c.SubjectParams()[name]
+}
+
 func (c *Context) UserInfo() *UserInfo {
 	userInfo, ok := c.Value(XUserInfo).(*UserInfo)
 	if ok {
@@ -205,5 +234,17 @@ func (c *Context) LoginToCareProviderAsRoleMustBeUsedAfterAuthentication(carePro
 }
 
 type GlobalCache struct {
-	Data map[string]interface{}
+	Data     map[string]interface{}
+	callsMux sync.Mutex
+	calls    map[string]uint64 // calls per target made with a derived Idempotency-Key, see callIdempotencyKey
+}
+
+func (g *GlobalCache) nextCall(target string) uint64 {
+	g.callsMux.Lock()
+	defer g.callsMux.Unlock()
+	if g.calls == nil {
+		g.calls = map[string]uint64{}
+	}
+	g.calls[target]++
+	return g.calls[target]
 }
@@ -0,0 +1,81 @@
+package titan
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	XDeadLetterError    = "X-Dead-Letter-Error"
+	XDeadLetterAttempts = "X-Dead-Letter-Attempts"
+	XDeadLetterSubject  = "X-Dead-Letter-Subject" // subject the message failed on
+)
+
+// RegistrationOption configures a message subscriber registration.
+type RegistrationOption func(*Registration)
+
+// DeadLetterSubject republishes messages the handler failed on to the subject, with the original headers,
+// the error, the number of attempts and the failing subject. Durable messages are dead-lettered once
+// MaxDeliver is reached. See Client.ReplayDeadLetters.
+func DeadLetterSubject(subject string) RegistrationOption {
+	return func(r *Registration) {
+		r.DeadLetter = subject
+	}
+}
+
+// deadLetter reports the failure and republishes the message to the dead-letter subject of the registration
+func (s *MessageSubscriber) deadLetter(conn *nats.EncodedConn, registration *Registration, subject string, m *Message, cause error, attempts int) {
+	logInfo := map[string]interface{}{"subject": subject, "attempts": attempts, "err": cause.Error()}
+	if registration.DeadLetter == "" {
+		s.logger.Error("Nats message handler error", logInfo)
+		return
+	}
+	logInfo["deadLetter"] = registration.DeadLetter
+	s.logger.Error("Nats message handler error, message dead-lettered", logInfo)
+
+	headers := http.Header{}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers.Set(XDeadLetterError, cause.Error())
+	headers.Set(XDeadLetterAttempts, strconv.Itoa(attempts))
+	headers.Set(XDeadLetterSubject, subject)
+
+	msg, err := newMessageMsg(conn, registration.DeadLetter, &Message{Headers: headers, Body: m.Body})
+	if err == nil {
+		err = conn.Conn.PublishMsg(msg)
+	}
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Nats dead letter publish error: %+v\n ", err))
+	}
+}
+
+// ReplayDeadLetter publishes a dead-lettered message to the subject it failed on, without the failure headers.
+// It can be registered as handler of a durable consumer of the dead-letter subject.
+func (srv *Client) ReplayDeadLetter(m *Message) error {
+	subject := m.Headers.Get(XDeadLetterSubject)
+	if subject == "" {
+		return errors.New("message is not a dead letter, " + XDeadLetterSubject + " header not found")
+	}
+	headers := http.Header{}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers.Del(XDeadLetterError)
+	headers.Del(XDeadLetterAttempts)
+	headers.Del(XDeadLetterSubject)
+	return srv.conn.Publish(subject, &Message{Headers: headers, Body: m.Body})
+}
+
+// ReplayDeadLetters replays every message published to the dead-letter subject until the subscription is unsubscribed.
+func (srv *Client) ReplayDeadLetters(deadLetterSubject string) (ISubscription, error) {
+	return srv.conn.Subscribe(deadLetterSubject, func(m *Message) {
+		if err := srv.ReplayDeadLetter(m); err != nil {
+			GetLogger().Error(fmt.Sprintf("Nats dead letter replay error: %+v\n ", err))
+		}
+	})
+}
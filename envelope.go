@@ -0,0 +1,185 @@
+package titan
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// Binary envelope: the metadata of a Request/Response/Message travels in native NATS headers and the
+// message data is the raw body, instead of a JSON object with a base64 body.
+//
+// Servers answer binary requests on BinarySubject(subject) next to the JSON subject. A client configured with
+// Nats.Envelope=binary sends its requests there and falls back to JSON while no upgraded instance listens,
+// so old and new services coexist during a migration. Replies are decoded by their envelope either way.
+//
+// Published messages have no responder to negotiate with, they stay JSON until Nats.MessageEnvelope=binary
+// is configured, which the publisher does once every subscriber of its subjects is upgraded.
+
+const (
+	EnvelopeJSON   = "json"
+	EnvelopeBinary = "binary"
+
+	XEnvelope       = "X-Envelope" // NATS header marking a binary envelope
+	XEnvelopeMethod = "X-Envelope-Method"
+	XEnvelopeUrl    = "X-Envelope-Url"
+	XEnvelopeStatus = "X-Envelope-Status"
+	XEnvelopeReason = "X-Envelope-Reason"
+
+	// how long a subject without binary responders is sent JSON before binary is tried again
+	envelopeFallbackInterval = time.Minute
+
+	binarySubjectPrefix = "binary."
+)
+
+// BinarySubject is the subject servers receive binary envelope requests on.
+func BinarySubject(subject string) string {
+	return binarySubjectPrefix + subject
+}
+
+func isBinaryEnvelope(msg *nats.Msg) bool {
+	return msg.Header.Get(XEnvelope) == EnvelopeBinary
+}
+
+// useBinaryEnvelope reports whether the connection is configured for and able to send binary envelopes
+func useBinaryEnvelope(conn *nats.Conn) bool {
+	return GetNatsConfig().Envelope == EnvelopeBinary && conn.HeadersSupported()
+}
+
+// useBinaryMessageEnvelope reports whether messages are published in the binary envelope
+func useBinaryMessageEnvelope(conn *nats.Conn) bool {
+	return GetNatsConfig().MessageEnvelope == EnvelopeBinary && conn.HeadersSupported()
+}
+
+func envelopeHeader(headers http.Header) nats.Header {
+	h := nats.Header{}
+	for k, v := range headers {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set(XEnvelope, EnvelopeBinary)
+	return h
+}
+
+// takeEnvelopeHeader removes the envelope fields and returns the remaining http headers
+func takeEnvelopeHeader(h nats.Header, keys ...string) (http.Header, map[string]string) {
+	headers := http.Header{}
+	for k, v := range h {
+		headers[k] = v
+	}
+	fields := map[string]string{}
+	for _, k := range append(keys, XEnvelope) {
+		fields[k] = headers.Get(k)
+		headers.Del(k)
+	}
+	return headers, fields
+}
+
+func encodeRequest(subject string, rq *Request) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header = envelopeHeader(rq.Headers)
+	msg.Header.Set(XEnvelopeMethod, rq.Method)
+	msg.Header.Set(XEnvelopeUrl, rq.URL)
+	msg.Data = rq.Body
+	return msg
+}
+
+// decodeRequest reads a request of either envelope
+func decodeRequest(enc *nats.EncodedConn, msg *nats.Msg) (*Request, error) {
+	if !isBinaryEnvelope(msg) {
+		var rq Request
+		if err := enc.Enc.Decode(msg.Subject, msg.Data, &rq); err != nil {
+			return nil, err
+		}
+		rq.Headers = readMetadata(rq.Headers, msg)
+		return &rq, nil
+	}
+	headers, fields := takeEnvelopeHeader(msg.Header, XEnvelopeMethod, XEnvelopeUrl)
+	return &Request{
+		Headers: headers,
+		Method:  fields[XEnvelopeMethod],
+		URL:     fields[XEnvelopeUrl],
+		Body:    msg.Data,
+	}, nil
+}
+
+func encodeResponse(subject string, rp *Response) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header = envelopeHeader(rp.Headers)
+	msg.Header.Set(XEnvelopeStatus, strconv.Itoa(rp.StatusCode))
+	if rp.Status != "" {
+		msg.Header.Set(XEnvelopeReason, rp.Status)
+	}
+	msg.Data = rp.Body
+	return msg
+}
+
+// decodeResponse reads a response of either envelope
+func decodeResponse(enc *nats.EncodedConn, msg *nats.Msg) (*Response, error) {
+	if !isBinaryEnvelope(msg) {
+		rp := &Response{}
+		if err := enc.Enc.Decode(msg.Subject, msg.Data, rp); err != nil {
+			return nil, errors.WithMessage(err, "nats response decoding error")
+		}
+		return rp, nil
+	}
+	headers, fields := takeEnvelopeHeader(msg.Header, XEnvelopeStatus, XEnvelopeReason)
+	statusCode, err := strconv.Atoi(fields[XEnvelopeStatus])
+	if err != nil {
+		return nil, errors.WithMessage(err, "nats response status decoding error")
+	}
+	return &Response{
+		Status:     fields[XEnvelopeReason],
+		StatusCode: statusCode,
+		Headers:    headers,
+		Body:       msg.Data,
+	}, nil
+}
+
+func encodeMessage(subject string, m *Message) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header = envelopeHeader(m.Headers)
+	msg.Data = m.Body
+	return msg
+}
+
+// decodeMessage reads a message of either envelope
+func decodeMessage(enc *nats.EncodedConn, msg *nats.Msg) (*Message, error) {
+	if !isBinaryEnvelope(msg) {
+		var m Message
+		if err := enc.Enc.Decode(msg.Subject, msg.Data, &m); err != nil {
+			return nil, err
+		}
+		m.Headers = readMetadata(m.Headers, msg)
+		return &m, nil
+	}
+	headers, _ := takeEnvelopeHeader(msg.Header)
+	return &Message{Headers: headers, Body: msg.Data}, nil
+}
+
+// publishResponse replies in the envelope of the request
+func publishResponse(enc *nats.EncodedConn, rpSubject string, rp *Response, binary bool) error {
+	if binary {
+		return enc.Conn.PublishMsg(encodeResponse(rpSubject, rp))
+	}
+	return enc.Publish(rpSubject, rp)
+}
+
+// sendBinaryRequest sends the request to the binary subject, it returns nats.ErrNoResponders
+// while no instance of the service understands the binary envelope.
+func (c *Connection) sendBinaryRequest(ctx context.Context, rq *Request, subject string) (*Response, error) {
+	if until, ok := c.jsonFallback.Load(subject); ok && time.Now().Before(until.(time.Time)) {
+		return nil, nats.ErrNoResponders
+	}
+	reply, err := c.Conn.Conn.RequestMsgWithContext(ctx, encodeRequest(BinarySubject(subject), rq))
+	if err == nats.ErrNoResponders {
+		c.jsonFallback.Store(subject, time.Now().Add(envelopeFallbackInterval))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(c.Conn, reply)
+}
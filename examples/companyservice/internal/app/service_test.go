@@ -14,14 +14,21 @@ import (
 	"gitlab.com/silenteer-oss/titan"
 
 	"gitlab.com/silenteer-oss/titan/examples/companyservice/api"
+	"gitlab.com/silenteer-oss/titan/test"
 
 	"github.com/stretchr/testify/assert"
 )
 
-var natsClient = titan.GetDefaultClient()
-var companyService = api.NewCompanyClient(natsClient)
+var companyService *api.CompanyClient
 
 func TestMain(m *testing.M) {
+	embeddedNats, err := test.NewEmbeddedNats()
+	if err != nil {
+		fmt.Printf("Embedded nats start error: %+v\n", err)
+		os.Exit(1)
+	}
+	companyService = api.NewCompanyClient(titan.GetDefaultClient())
+
 	server := app.NewServer()
 
 	go func() {
@@ -33,6 +40,7 @@ func TestMain(m *testing.M) {
 	exitVal := m.Run()
 
 	server.Stop()
+	embeddedNats.Shutdown()
 	os.Exit(exitVal)
 }
 
@@ -65,3 +73,14 @@ func TestGetExistCompany(t *testing.T) {
 	require.NotNil(t, company)
 	assert.Equal(t, company.Name, "hung")
 }
+
+func TestGetExistCompanyInMemory(t *testing.T) {
+	context := titan.NewContext(context.Background())
+	conn := titan.NewMemoryConnection(app.NewCompanyService(app.NewCompanyRepository()).Routes)
+	client := api.NewCompanyClient(titan.NewClient(conn))
+
+	company, err := client.GetCompany(context, "hung")
+	require.NoError(t, err, fmt.Sprintf("Get Company error: %+v\n ", err))
+	require.NotNil(t, company)
+	assert.Equal(t, company.Name, "hung")
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"gitlab.com/silenteer-oss/titan/examples/companyservice/internal/app"
 )
 
 func main() {
-	app.NewServer().Start()
+	if err := app.NewServer().Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -27,6 +27,8 @@ func (h *DefaultHandlers) Register(r Router) {
 	}
 
 	r.RegisterJson("GET", basePath+"/health", h.Health)
+	r.RegisterJson("GET", basePath+"/health/live", h.Live)
+	r.Register("GET", basePath+"/health/ready", h.Ready)
 	r.RegisterJson("GET", basePath+"/info", h.AppInfo)
 }
 
@@ -35,6 +37,21 @@ func (h *DefaultHandlers) Health(ctx *Context) (*Health, error) {
 	return &health, nil
 }
 
+// Live reports the process is up, dependencies are not checked
+func (h *DefaultHandlers) Live(ctx *Context) (*Health, error) {
+	health := h.DoHealthCheck()
+	return &health, nil
+}
+
+// Ready answers 503 while a critical checker fails
+func (h *DefaultHandlers) Ready(ctx *Context, rq *Request) *Response {
+	health := h.DoReadinessCheck(ctx)
+	return NewResBuilder().
+		StatusCode(healthStatusCode(health)).
+		BodyJSON(&health).
+		Build()
+}
+
 //see BuildInfoSource.java
 func (h *DefaultHandlers) AppInfo(ctx *Context) (*AppInfo, error) {
 	return &AppInfo{Build: BuildInfo{
@@ -46,8 +63,10 @@ func (h *DefaultHandlers) AppInfo(ctx *Context) (*AppInfo, error) {
 
 func (h *DefaultHandlers) Subscribe(s *MessageSubscriber) {
 	healthCheckSubject := fmt.Sprintf("%s_%s", HEALTH_CHECK, strings.ReplaceAll(hostname, " ", "_"))
+	// the reply includes the readiness checks, like /health/ready
 	s.Register(healthCheckSubject, "", func(m *Message) error {
-		return GetDefaultClient().Publish(NewBackgroundContext(), HEALTH_CHECK_REPLY, h.DoHealthCheck())
+		ctx := NewBackgroundContext()
+		return GetDefaultClient().Publish(ctx, HEALTH_CHECK_REPLY, h.DoReadinessCheck(ctx))
 	})
 	s.Register(MONITORING_CHECK, "", func(m *Message) error {
 		return GetDefaultClient().Publish(NewBackgroundContext(), MONITORING_CHECK_REPLY, DoMonitoringCheck(h.Subject, m))
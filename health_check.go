@@ -1,20 +1,64 @@
 package titan
 
 import (
+	"context"
+	"net/http"
 	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 const (
 	HEALTH_CHECK       = "health_check"
 	HEALTH_CHECK_REPLY = "health_check_reply"
 	UP                 = "UP"
+	DOWN               = "DOWN"
+
+	defaultHealthCheckTimeout = 5 * time.Second
 )
 
 type Health struct {
+	Status   string                 `json:"status"`
+	HostName string                 `json:"hostName"`
+	Subject  string                 `json:"subject"`
+	Language string                 `json:"language"`
+	Checks   map[string]CheckResult `json:"checks,omitempty"` // readiness checks by name
+}
+
+// CheckResult is the outcome of one HealthChecker.
+type CheckResult struct {
 	Status   string `json:"status"`
-	HostName string `json:"hostName"`
-	Subject  string `json:"subject"`
-	Language string `json:"language"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration"` // milliseconds
+}
+
+// HealthChecker checks a dependency of the service, e.g. its database or a downstream subject.
+// A failing critical checker makes the service not ready, others are only reported.
+type HealthChecker struct {
+	Name     string
+	Check    func(ctx context.Context) error
+	Timeout  time.Duration // 5 seconds by default
+	Critical bool
+}
+
+var healthCheckersMux sync.RWMutex
+var healthCheckers = map[string]HealthChecker{}
+
+// RegisterHealthChecker adds the checker to the readiness checks, a checker of the same name is replaced.
+func RegisterHealthChecker(checker HealthChecker) {
+	healthCheckersMux.Lock()
+	defer healthCheckersMux.Unlock()
+	healthCheckers[checker.Name] = checker
+}
+
+// UnregisterHealthChecker removes the checker of the name from the readiness checks.
+func UnregisterHealthChecker(name string) {
+	healthCheckersMux.Lock()
+	defer healthCheckersMux.Unlock()
+	delete(healthCheckers, name)
 }
 
 func HealthCheck(ctx *Context, subject string) (*Health, error) {
@@ -38,3 +82,81 @@ func (h *DefaultHandlers) DoHealthCheck() Health {
 	}
 	return health
 }
+
+// DoReadinessCheck runs the registered checkers concurrently, the status is DOWN when a critical one fails.
+func (h *DefaultHandlers) DoReadinessCheck(ctx context.Context) Health {
+	health := h.DoHealthCheck()
+
+	healthCheckersMux.RLock()
+	checkers := make([]HealthChecker, 0, len(healthCheckers))
+	for _, checker := range healthCheckers {
+		checkers = append(checkers, checker)
+	}
+	healthCheckersMux.RUnlock()
+	if len(checkers) == 0 {
+		return health
+	}
+
+	results := make([]CheckResult, len(checkers))
+	var wg sync.WaitGroup
+	for i := range checkers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = runHealthChecker(ctx, checkers[i])
+		}(i)
+	}
+	wg.Wait()
+
+	health.Checks = map[string]CheckResult{}
+	for i, checker := range checkers {
+		health.Checks[checker.Name] = results[i]
+		if checker.Critical && results[i].Status != UP {
+			health.Status = DOWN
+		}
+	}
+	return health
+}
+
+func runHealthChecker(ctx context.Context, checker HealthChecker) CheckResult {
+	timeout := checker.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errs <- errors.Errorf("panic : %v", r)
+			}
+		}()
+		errs <- checker.Check(ctx)
+	}()
+
+	// a checker ignoring its context must not block the health check
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := CheckResult{Status: UP, Critical: checker.Critical, Duration: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Status = DOWN
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// healthStatusCode lets orchestrators take a service which is not ready out of rotation
+func healthStatusCode(health Health) int {
+	if health.Status != UP {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,78 @@
+package titan
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"logur.dev/logur"
+)
+
+// Hook runs at a point of the server lifecycle, see OnStarting.
+type Hook func(ctx context.Context) error
+
+type lifecycleHooks struct {
+	starting []Hook
+	started  []Hook
+	stopping []Hook
+	stopped  []Hook
+}
+
+// OnStarting runs before the server subscribes to its subject, e.g. to open database pools.
+// The server does not start when a hook fails and Run returns the error, no request arrives before all of them succeeded.
+// When the server fails to start after them, the stopping and stopped hooks run to release what they acquired.
+func OnStarting(hook Hook) Option {
+	return func(o *Options) error {
+		o.hooks.starting = append(o.hooks.starting, hook)
+		return nil
+	}
+}
+
+// OnStarted runs once the server receives requests, the server stops again when a hook fails and Run returns the error.
+func OnStarted(hook Hook) Option {
+	return func(o *Options) error {
+		o.hooks.started = append(o.hooks.started, hook)
+		return nil
+	}
+}
+
+// OnStopping runs when the server is asked to stop, before it stops receiving requests.
+func OnStopping(hook Hook) Option {
+	return func(o *Options) error {
+		o.hooks.stopping = append(o.hooks.stopping, hook)
+		return nil
+	}
+}
+
+// OnStopped runs after the in-flight requests finished and the subscriptions are drained, e.g. to close database pools.
+func OnStopped(hook Hook) Option {
+	return func(o *Options) error {
+		o.hooks.stopped = append(o.hooks.stopped, hook)
+		return nil
+	}
+}
+
+// runStartHooks runs the hooks in order until one fails
+func runStartHooks(ctx context.Context, hooks []Hook, stage string) error {
+	for _, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			return errors.WithMessagef(err, "Nats server %s hook error ", stage)
+		}
+	}
+	return nil
+}
+
+// runStopHooks runs all hooks so every resource gets released, it returns the first error
+func runStopHooks(ctx context.Context, logger logur.Logger, hooks []Hook, stage string) error {
+	var first error
+	for _, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			err = errors.WithMessagef(err, "Nats server %s hook error ", stage)
+			logger.Error(fmt.Sprintf("%+v\n ", err))
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
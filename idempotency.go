@@ -0,0 +1,311 @@
+package titan
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	XIdempotencyKey     = "Idempotency-Key"
+	XIdempotentReplayed = "Idempotent-Replayed" // set on responses replayed for a repeated key
+
+	defaultIdempotencyTTL      = 24 * time.Hour
+	defaultIdempotencyCapacity = 10000
+
+	// a key is reserved this long while its first request runs, unless the request has a deadline
+	defaultIdempotencyReservationTTL = time.Minute
+
+	idempotencyInProgress = "Idempotency-In-Progress" // marks the reservation of a key
+	idempotentCall        = "X-Idempotent-Call"       // name of the calls of the context, see Context.WithIdempotentCall
+)
+
+// errIdempotencyInProgress fails a repeated message while the first one is handled, so it is delivered again later
+var errIdempotencyInProgress = errors.New("message with the Idempotency-Key is being handled")
+
+// IdempotencyStore keeps the results of requests and messages by their Idempotency-Key,
+// implement it on Redis or SQL to share them between the instances of a service.
+// PutIfAbsent must be atomic, e.g. SET NX, it reserves the key while its first request runs.
+type IdempotencyStore interface {
+	Get(ctx context.Context, key string) (*Response, bool, error)
+	Put(ctx context.Context, key string, rp *Response, ttl time.Duration) error
+	PutIfAbsent(ctx context.Context, key string, rp *Response, ttl time.Duration) (bool, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var idempotencyMux sync.RWMutex
+var idempotencyStore IdempotencyStore = NewMemoryIdempotencyStore(defaultIdempotencyCapacity)
+var idempotencyTTL = defaultIdempotencyTTL
+
+// SetIdempotencyStore replaces the in-memory store, results are kept for ttl.
+func SetIdempotencyStore(store IdempotencyStore, ttl time.Duration) {
+	idempotencyMux.Lock()
+	defer idempotencyMux.Unlock()
+	idempotencyStore = store
+	idempotencyTTL = ttl
+}
+
+func getIdempotencyStore() (IdempotencyStore, time.Duration) {
+	idempotencyMux.RLock()
+	defer idempotencyMux.RUnlock()
+	return idempotencyStore, idempotencyTTL
+}
+
+// idempotencyScope is the user and tenant of the context, the same key of another user is another request.
+// Anonymous requests have no scope, their key may as well be the one of another caller.
+func idempotencyScope(ctx *Context) (string, bool) {
+	userInfo := ctx.UserInfo()
+	if userInfo == nil {
+		return "", false
+	}
+	return userInfo.CareProviderId.String() + "/" + userInfo.UserId.String(), true
+}
+
+// callIdempotencyKey derives the key of a call made while handling a request or message with an Idempotency-Key.
+// Calls named with Context.WithIdempotentCall get the key of their name, the others are numbered per target:
+// handling the request again repeats the calls to a target in the same order with the same keys, so calls to
+// the same target made concurrently must be named.
+func callIdempotencyKey(ctx *Context, target string) string {
+	parent := ctx.IdempotencyKey()
+	if parent == "" {
+		return ""
+	}
+	call, _ := ctx.Value(idempotentCall).(string)
+	if call == "" {
+		var seq uint64
+		if cache, ok := ctx.Value(XGlobalCache).(*GlobalCache); ok {
+			seq = cache.nextCall(target)
+		}
+		call = strconv.FormatUint(seq, 10)
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s", parent, target, call)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// idempotencyReservation is kept for the key while its first request runs, it answers the repeated ones
+func idempotencyReservation() *Response {
+	headers := http.Header{}
+	headers.Set(idempotencyInProgress, "true")
+	return &Response{
+		StatusCode: http.StatusConflict,
+		Status:     "A request with the Idempotency-Key is in progress",
+		Headers:    headers,
+	}
+}
+
+func reservationTTL(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if ttl := time.Until(deadline); ttl > 0 {
+			return ttl
+		}
+	}
+	return defaultIdempotencyReservationTTL
+}
+
+// reserveIdempotencyKey returns the stored response of a repeated key, the reservation while its first request runs,
+// or nil when the key is reserved for the caller. The key is not reserved when the store fails.
+func reserveIdempotencyKey(ctx context.Context, store IdempotencyStore, key string) (*Response, error) {
+	for i := 0; i < 3; i++ {
+		reserved, err := store.PutIfAbsent(ctx, key, idempotencyReservation(), reservationTTL(ctx))
+		if err != nil || reserved {
+			return nil, err
+		}
+		rp, ok, err := store.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		// gone in between, e.g. expired or released after a server error
+		if ok {
+			if rp.Headers == nil {
+				rp.Headers = http.Header{}
+			}
+			return rp, nil
+		}
+	}
+	return nil, errors.Errorf("cannot reserve Idempotency-Key %s", key)
+}
+
+// handleIdempotent replays the response of a repeated key instead of calling the handler again,
+// a repeated key is answered with 409 while its first request runs.
+// Server errors and streams are not kept, so the request can be retried. Anonymous requests are not deduplicated.
+func handleIdempotent(ctx *Context, key string, handle func() *Response) *Response {
+	scope, ok := idempotencyScope(ctx)
+	if !ok {
+		ctx.Logger().Debug("Idempotency-Key of anonymous request ignored", map[string]interface{}{"key": key})
+		return handle()
+	}
+	key = scope + " " + key
+	store, ttl := getIdempotencyStore()
+	stored, err := reserveIdempotencyKey(ctx, store, key)
+	if err != nil {
+		ctx.Logger().Error(fmt.Sprintf("Idempotency store error: %+v\n ", err))
+	} else if stored != nil {
+		if stored.Headers.Get(idempotencyInProgress) != "" {
+			ctx.Logger().Debug("Idempotent request in progress", map[string]interface{}{"key": key})
+			return stored
+		}
+		ctx.Logger().Debug("Idempotent request replayed", map[string]interface{}{"key": key})
+		stored.Headers.Set(XIdempotentReplayed, "true")
+		return stored
+	}
+
+	rp := handle()
+	if rp.Stream == nil && rp.StatusCode < http.StatusInternalServerError {
+		err = store.Put(ctx, key, rp, ttl)
+	} else {
+		err = store.Delete(ctx, key)
+	}
+	if err != nil {
+		ctx.Logger().Error(fmt.Sprintf("Idempotency store error: %+v\n ", err))
+	}
+	return rp
+}
+
+// idempotentMessageHandler skips messages whose key was handled successfully before,
+// a repeated message fails while the first one is handled.
+// Nothing is replayed to the publisher, so anonymous messages, e.g. outbox events of jobs, are deduplicated as well.
+func (s *MessageSubscriber) idempotentMessageHandler(scope string, next MessageHandler) MessageHandler {
+	return func(m *Message) error {
+		key := m.Headers.Get(XIdempotencyKey)
+		if key == "" {
+			return next(m)
+		}
+		user := ""
+		if ctx, err := m.context(); err == nil {
+			user, _ = idempotencyScope(ctx)
+		}
+		key = scope + " " + user + " " + key
+
+		ctx := context.Background()
+		store, ttl := getIdempotencyStore()
+		stored, err := reserveIdempotencyKey(ctx, store, key)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Idempotency store error: %+v\n ", err))
+		} else if stored != nil {
+			if stored.Headers.Get(idempotencyInProgress) != "" {
+				return errIdempotencyInProgress
+			}
+			s.logger.Debug("Duplicate message skipped", map[string]interface{}{"key": key})
+			return nil
+		}
+
+		if err = next(m); err != nil {
+			if er := store.Delete(ctx, key); er != nil {
+				s.logger.Error(fmt.Sprintf("Idempotency store error: %+v\n ", er))
+			}
+			return err
+		}
+		if err := store.Put(ctx, key, &Response{StatusCode: http.StatusOK}, ttl); err != nil {
+			s.logger.Error(fmt.Sprintf("Idempotency store error: %+v\n ", err))
+		}
+		return nil
+	}
+}
+
+type idempotencyEntry struct {
+	key     string
+	rp      *Response
+	expires time.Time
+}
+
+// memoryIdempotencyStore is an LRU cache whose entries expire after their ttl
+type memoryIdempotencyStore struct {
+	mux      sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List // most recently used first
+}
+
+// NewMemoryIdempotencyStore keeps up to capacity results in memory, the least recently used go first.
+func NewMemoryIdempotencyStore(capacity int) IdempotencyStore {
+	return &memoryIdempotencyStore{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+func (s *memoryIdempotencyStore) Get(ctx context.Context, key string) (*Response, bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	entry := s.get(key)
+	if entry == nil {
+		return nil, false, nil
+	}
+	return copyResponse(entry.rp), true, nil
+}
+
+// get returns the entry of the key unless it expired
+func (s *memoryIdempotencyStore) get(key string) *idempotencyEntry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*idempotencyEntry)
+	if time.Now().After(entry.expires) {
+		s.lru.Remove(e)
+		delete(s.entries, key)
+		return nil
+	}
+	s.lru.MoveToFront(e)
+	return entry
+}
+
+func (s *memoryIdempotencyStore) Put(ctx context.Context, key string, rp *Response, ttl time.Duration) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.put(key, rp, ttl)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) PutIfAbsent(ctx context.Context, key string, rp *Response, ttl time.Duration) (bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.get(key) != nil {
+		return false, nil
+	}
+	s.put(key, rp, ttl)
+	return true, nil
+}
+
+func (s *memoryIdempotencyStore) Delete(ctx context.Context, key string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.entries[key]; ok {
+		s.lru.Remove(e)
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) put(key string, rp *Response, ttl time.Duration) {
+	entry := &idempotencyEntry{key: key, rp: copyResponse(rp), expires: time.Now().Add(ttl)}
+	if e, ok := s.entries[key]; ok {
+		e.Value = entry
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.entries[key] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.capacity {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*idempotencyEntry).key)
+	}
+}
+
+func copyResponse(rp *Response) *Response {
+	c := *rp
+	c.Headers = rp.Headers.Clone()
+	if c.Headers == nil {
+		c.Headers = http.Header{}
+	}
+	return &c
+}
@@ -0,0 +1,95 @@
+package titan
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// DurableOptions configures the JetStream consumer of a durable registration.
+type DurableOptions struct {
+	Subject    string        // subject filter inside the stream, all subjects of the stream when empty, may be a template
+	MaxDeliver int           // deliveries of a failing message before it is given up, 5 by default
+	AckWait    time.Duration // time the handler has before the message is delivered again, 30 seconds by default
+}
+
+// RegisterDurable consumes the JetStream stream with a durable consumer, messages published while the service
+// is down are delivered once it is up again. The stream must exist, see Client.PublishPersistent.
+// A message is acknowledged when the handler returns nil, otherwise it is delivered again up to MaxDeliver times.
+// All instances of the service share the consumer, every message is handled by one of them.
+func (s *MessageSubscriber) RegisterDurable(stream, consumer string, handler MessageHandler, opts *DurableOptions, regOpts ...RegistrationOption) {
+	if opts == nil {
+		opts = &DurableOptions{}
+	}
+	template, err := parseSubjectTemplate(opts.Subject)
+	if err != nil {
+		panic(fmt.Sprintf("titan: RegisterDurable: %s", err.Error()))
+	}
+	registration := &Registration{
+		Subject:  template.pattern,
+		Handler:  s.createHandlerWithRecover(handler),
+		Stream:   stream,
+		Consumer: consumer,
+		Durable:  opts,
+		template: template,
+	}
+	for _, opt := range regOpts {
+		opt(registration)
+	}
+	s.add(registration)
+}
+
+func (s *MessageSubscriber) subscribeDurable(conn *nats.EncodedConn, registration *Registration) (*nats.Subscription, error) {
+	js, err := conn.Conn.JetStream()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Nats jetstream error ")
+	}
+
+	maxDeliver := registration.Durable.MaxDeliver
+	if maxDeliver <= 0 {
+		maxDeliver = 5
+	}
+	ackWait := registration.Durable.AckWait
+	if ackWait <= 0 {
+		ackWait = 30 * time.Second
+	}
+
+	handler := registration.Handler
+	return js.QueueSubscribe(registration.Subject, registration.Consumer, s.dispatch(registration, func(msg *nats.Msg) {
+		m, err := decodeMessage(conn, msg)
+		if err != nil {
+			// it will never be decoded, no need to deliver it again
+			s.logger.Error(fmt.Sprintf("Nats durable message decoding error: %+v\n ", err))
+			_ = msg.Term()
+			return
+		}
+		m.Subject = msg.Subject
+		m.subjectParams = registration.template.params(msg.Subject)
+		if err := handler(m); err != nil {
+			attempts := 1
+			if meta, merr := msg.Metadata(); merr == nil {
+				attempts = int(meta.NumDelivered)
+			}
+			if attempts >= maxDeliver {
+				// last delivery, JetStream gives up on the message
+				s.deadLetter(conn, registration, msg.Subject, m, err, attempts)
+				_ = msg.Term()
+				return
+			}
+			s.logger.Warn("Nats durable message handler error", map[string]interface{}{"stream": registration.Stream, "consumer": registration.Consumer, "attempts": attempts, "err": err.Error()})
+			_ = msg.Nak()
+			return
+		}
+		_ = msg.Ack()
+	}),
+		nats.BindStream(registration.Stream),
+		nats.Durable(registration.Consumer),
+		nats.DeliverAll(),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.MaxDeliver(maxDeliver),
+		nats.AckWait(ackWait),
+	)
+}
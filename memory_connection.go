@@ -0,0 +1,266 @@
+package titan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+)
+
+// MemoryConnection is an in-process loopback IConnection.
+// Requests are served by a Router without any network, published messages are
+// delivered synchronously to the callbacks registered with Subscribe.
+// Message requests are not supported, reply handlers run in a MessageSubscriber of a NATS server only.
+// It is meant for unit testing clients and for local development.
+type MemoryConnection struct {
+	seq           uint64 // sequence of persistent messages, first for 64-bit atomic alignment
+	handler       Router
+	mux           sync.Mutex
+	subscriptions []*memorySubscription
+}
+
+// NewMemoryConnection creates a loopback connection serving the given routes,
+// e.g. NewClient(NewMemoryConnection(companyService.Routes)).
+func NewMemoryConnection(routes ...func(Router)) *MemoryConnection {
+	r := chi.NewRouter()
+	r.Use(
+		NewMiddleware("Memory", "memory", GetLogger()),
+	)
+	router := NewRouter(r)
+	for _, route := range routes {
+		route(router)
+	}
+	return &MemoryConnection{handler: router}
+}
+
+// Router returns the router requests are dispatched to, more routes can be registered on it.
+func (c *MemoryConnection) Router() Router {
+	return c.handler
+}
+
+func (c *MemoryConnection) SendRequest(rq *Request, subject string) (*Response, error) {
+	return c.SendRequestWithContext(context.Background(), rq, subject)
+}
+
+func (c *MemoryConnection) SendRequestWithContext(ctx context.Context, rq *Request, subject string) (*Response, error) {
+	return c.serve(ctx, rq, subject, nil)
+}
+
+// SendUploadRequest serves the request in-process with body as the request body.
+func (c *MemoryConnection) SendUploadRequest(ctx context.Context, rq *Request, subject string, body io.Reader) (*Response, error) {
+	return c.serve(ctx, rq, subject, ioutil.NopCloser(body))
+}
+
+func (c *MemoryConnection) serve(ctx context.Context, rq *Request, subject string, body io.ReadCloser) (*Response, error) {
+	if subject == "" {
+		return nil, errors.New("memory subject cannot be nil")
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	httpReq, err := NatsRequestToHttpRequest(rq)
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	if body != nil {
+		httpReq.Body = body
+		httpReq.ContentLength = -1
+	}
+
+	rp := &Response{Headers: http.Header{}}
+	c.handler.ServeHTTP(rp, httpReq)
+	if rp.StatusCode == 0 {
+		rp.StatusCode = http.StatusOK
+	}
+	rp.Headers.Set(XResponeTime, strconv.FormatInt(time.Now().UnixNano(), 10))
+	rp.Headers.Set(XHostname, hostname)
+
+	return rp, nil
+}
+
+// ScatterGather returns the single reply of the in-process router.
+func (c *MemoryConnection) ScatterGather(ctx context.Context, rq *Request, subject string, maxReplies int) ([]*Response, error) {
+	rp, err := c.SendRequestWithContext(ctx, rq, subject)
+	if err != nil {
+		return nil, err
+	}
+	return []*Response{rp}, nil
+}
+
+// SendStreamRequest serves the request in-process, the body is buffered before it is returned.
+func (c *MemoryConnection) SendStreamRequest(ctx context.Context, rq *Request, subject string) (*ResponseStream, error) {
+	rp, err := c.SendRequestWithContext(ctx, rq, subject)
+	if err != nil {
+		return nil, err
+	}
+	return &ResponseStream{
+		Status:     rp.Status,
+		StatusCode: rp.StatusCode,
+		Headers:    rp.Headers,
+		Body:       ioutil.NopCloser(bytes.NewReader(rp.Body)),
+	}, nil
+}
+
+func (c *MemoryConnection) Publish(subject string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithMessage(err, "memory publish json encoding error")
+	}
+
+	c.mux.Lock()
+	var matched []*memorySubscription
+	for _, sub := range c.subscriptions {
+		if subjectMatches(sub.subject, subject) {
+			matched = append(matched, sub)
+		}
+	}
+	c.mux.Unlock()
+
+	// a subscriber failing to decode the message does not keep it from the others
+	var failed []string
+	for _, sub := range matched {
+		if err := sub.deliver(subject, data); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("memory publish failed for %d of %d subscriptions: %s", len(failed), len(matched), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// PublishPersistent delivers the message like Publish and numbers it, nothing is stored.
+func (c *MemoryConnection) PublishPersistent(subject string, m *Message) (uint64, error) {
+	if err := c.Publish(subject, m); err != nil {
+		return 0, err
+	}
+	return atomic.AddUint64(&c.seq, 1), nil
+}
+
+// Subscribe accepts the same callback signatures as a JSON encoded NATS connection:
+// func(o *T), func(subject string, o *T) or func(subject, reply string, o *T).
+func (c *MemoryConnection) Subscribe(subject string, cb Handler) (ISubscription, error) {
+	if cb == nil {
+		return nil, errors.New("memory: Handler required for subscription")
+	}
+	cbType := reflect.TypeOf(cb)
+	if cbType.Kind() != reflect.Func {
+		return nil, errors.New("memory: Handler needs to be a func")
+	}
+	if cbType.NumIn() == 0 || cbType.NumIn() > 3 {
+		return nil, errors.New("memory: Handler requires one to three arguments")
+	}
+
+	sub := &memorySubscription{conn: c, subject: subject, cb: reflect.ValueOf(cb), argType: cbType.In(cbType.NumIn() - 1)}
+	c.mux.Lock()
+	c.subscriptions = append(c.subscriptions, sub)
+	c.mux.Unlock()
+	return sub, nil
+}
+
+func (c *MemoryConnection) Flush() error {
+	return nil
+}
+
+func (c *MemoryConnection) Close() {
+	c.mux.Lock()
+	c.subscriptions = nil
+	c.mux.Unlock()
+}
+
+func (c *MemoryConnection) Drain() {
+	c.Close()
+}
+
+func (c *MemoryConnection) unsubscribe(sub *memorySubscription) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for i, s := range c.subscriptions {
+		if s == sub {
+			c.subscriptions = append(c.subscriptions[:i], c.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+type memorySubscription struct {
+	conn    *MemoryConnection
+	subject string
+	cb      reflect.Value
+	argType reflect.Type
+}
+
+func (s *memorySubscription) deliver(subject string, data []byte) error {
+	var oPtr reflect.Value
+	if s.argType.Kind() != reflect.Ptr {
+		oPtr = reflect.New(s.argType)
+	} else {
+		oPtr = reflect.New(s.argType.Elem())
+	}
+	if err := json.Unmarshal(data, oPtr.Interface()); err != nil {
+		return errors.WithMessage(err, "memory subscription json decoding error")
+	}
+	if m, ok := oPtr.Interface().(*Message); ok {
+		m.Subject = subject
+	}
+	if s.argType.Kind() != reflect.Ptr {
+		oPtr = reflect.Indirect(oPtr)
+	}
+
+	var oV []reflect.Value
+	switch s.cb.Type().NumIn() {
+	case 1:
+		oV = []reflect.Value{oPtr}
+	case 2:
+		oV = []reflect.Value{reflect.ValueOf(subject), oPtr}
+	case 3:
+		oV = []reflect.Value{reflect.ValueOf(subject), reflect.ValueOf(""), oPtr}
+	}
+	s.cb.Call(oV)
+	return nil
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	s.conn.unsubscribe(s)
+	return nil
+}
+
+func (s *memorySubscription) Drain() error {
+	return s.Unsubscribe()
+}
+
+func (s *memorySubscription) SetPendingLimits(msgLimit, bytesLimit int) error {
+	return nil
+}
+
+// subjectMatches reports whether subject matches the NATS subject pattern,
+// where '*' matches a single token and '>' matches one or more trailing tokens.
+func subjectMatches(pattern, subject string) bool {
+	pTokens := strings.Split(pattern, ".")
+	sTokens := strings.Split(subject, ".")
+	for i, p := range pTokens {
+		if p == ">" {
+			return len(sTokens) > i
+		}
+		if i >= len(sTokens) {
+			return false
+		}
+		if p != "*" && p != sTokens[i] {
+			return false
+		}
+	}
+	return len(pTokens) == len(sTokens)
+}
@@ -3,6 +3,7 @@ package titan
 import (
 	"fmt"
 	"runtime/debug"
+	"sync"
 
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
@@ -15,29 +16,131 @@ type Registration struct {
 	Subject string
 	Queue   string
 	Handler MessageHandler
+
+	// durable registrations consume a JetStream stream, see RegisterDurable
+	Stream   string
+	Consumer string
+	Durable  *DurableOptions
+
+	DeadLetter  string // see DeadLetterSubject
+	Concurrency int    // see HandlerConcurrency
+
+	template subjectTemplate
 }
 
 type MessageSubscriber struct {
 	logger        logur.Logger
 	registrations []*Registration
 	subscriptions []*nats.Subscription
+	conn          *nats.EncodedConn
+	inFlight      sync.WaitGroup // messages being handled
 }
 
 func NewMessageSubscriber(logger logur.Logger) *MessageSubscriber {
 	return &MessageSubscriber{logger: logger}
 }
 
-func (s *MessageSubscriber) Register(subject string, queue string, handler MessageHandler) {
-	s.registrations = append(s.registrations, &Registration{
-		Subject: subject,
-		Queue:   queue,
-		Handler: s.createHandlerWithRecover(handler),
-	})
+// Register subscribes the handler to the subject, which may be a template with named tokens,
+// e.g. events.careprovider.{cpId}.patient.>, see Context.SubjectParams. It panics on invalid templates.
+func (s *MessageSubscriber) Register(subject string, queue string, handler MessageHandler, opts ...RegistrationOption) {
+	template, err := parseSubjectTemplate(subject)
+	if err != nil {
+		panic(fmt.Sprintf("titan: Register: %s", err.Error()))
+	}
+	registration := &Registration{
+		Subject:  template.pattern,
+		Queue:    queue,
+		Handler:  s.createHandlerWithRecover(handler),
+		template: template,
+	}
+	for _, opt := range opts {
+		opt(registration)
+	}
+	s.add(registration)
+}
+
+// add wraps the handler of the registration with the idempotency check and metrics, once its options are applied
+func (s *MessageSubscriber) add(registration *Registration) {
+	name := registration.Subject
+	if registration.Stream != "" {
+		name = registration.Stream + "/" + registration.Consumer
+	}
+	registration.Handler = observeMessageHandler(name, s.idempotentMessageHandler(name, registration.Handler))
+	s.registrations = append(s.registrations, registration)
+}
+
+// RegisterJson registers a typed handler `func(c *Context, body *T) error`, the body is decoded by the
+// message Content-Type and validated like the body of Router.RegisterJson handlers.
+// Messages which fail decoding or validation are handled as handler errors, see DeadLetterSubject.
+// The result of a handler `func(c *Context, body *T) (*R, error)` is sent back to the sender, see RegisterReply.
+// It panics when the handler has another signature.
+func (s *MessageSubscriber) RegisterJson(subject string, queue string, handler interface{}, opts ...RegistrationOption) {
+	if err := checkJsonHandler(handler); err != nil {
+		panic(fmt.Sprintf("titan: RegisterJson %s: %s", subject, err.Error()))
+	}
+	s.RegisterReply(subject, queue, func(m *Message) (interface{}, error) {
+		ctx, err := m.context()
+		if err != nil {
+			return nil, err
+		}
+		return callJsonHandler(ctx, requestCodec(m.Headers), m.Body, handler)
+	}, opts...)
+}
+
+// HandlerConcurrency handles up to max messages of the registration at the same time, one by one by default.
+// While all are busy further messages wait in the pending queue of the subscription, within the NATS client
+// default pending limits, messages past them are dropped. Durable registrations get theirs delivered again.
+func HandlerConcurrency(max int) RegistrationOption {
+	return func(r *Registration) {
+		r.Concurrency = max
+	}
+}
+
+// dispatch runs the callback in the NATS subscription goroutine, or bounded by the registration concurrency.
+// The messages being handled are tracked in inFlight for draining.
+func (s *MessageSubscriber) dispatch(registration *Registration, cb nats.MsgHandler) nats.MsgHandler {
+	if registration.Concurrency <= 1 {
+		return func(msg *nats.Msg) {
+			s.inFlight.Add(1)
+			defer s.inFlight.Done()
+			cb(msg)
+		}
+	}
+	sem := newSemaphore(registration.Concurrency)
+	return func(msg *nats.Msg) {
+		s.inFlight.Add(1)
+		sem.acquire()
+		go func() {
+			defer s.inFlight.Done()
+			defer sem.release()
+			cb(msg)
+		}()
+	}
 }
 
 func (s *MessageSubscriber) subscribe(conn *nats.EncodedConn) error {
+	s.conn = conn
 	for index, registration := range s.registrations {
-		sub, err := conn.QueueSubscribe(registration.Subject, registration.Queue, registration.Handler)
+		var sub *nats.Subscription
+		var err error
+		if registration.Stream != "" {
+			sub, err = s.subscribeDurable(conn, registration)
+		} else {
+			registration := registration
+			sub, err = conn.Conn.QueueSubscribe(registration.Subject, registration.Queue, s.dispatch(registration, func(msg *nats.Msg) {
+				m, err := decodeMessage(conn, msg)
+				if err != nil {
+					s.logger.Error(fmt.Sprintf("Nats message decoding error: %+v\n ", err))
+					return
+				}
+				m.Reply = msg.Reply
+				m.Subject = msg.Subject
+				m.subjectParams = registration.template.params(msg.Subject)
+				if err := registration.Handler(m); err != nil {
+					s.deadLetter(conn, registration, msg.Subject, m, err, 1)
+				}
+			}))
+		}
 		if err != nil {
 			return errors.WithMessagef(err, "Nats subscription [%d] error ", index)
 		}
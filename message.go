@@ -14,6 +14,10 @@ import (
 type Message struct {
 	Headers http.Header `json:"headers"`
 	Body    []byte      `json:"body"`
+	Reply   string      `json:"-"` // inbox of the sender waiting for a reply, see MessageSubscriber.RegisterReply
+	Subject string      `json:"-"` // subject the message was received on
+
+	subjectParams SubjectParams
 }
 
 func (r *Message) bodyJson(v interface{}) error {
@@ -45,6 +49,12 @@ func (r *Message) context() (*Context, error) {
 	ctx = context.WithValue(ctx, XRequestId, r.Headers.Get(XRequestId))
 	ctx = context.WithValue(ctx, XOrigin, r.Headers.Get(XOrigin))
 	ctx = context.WithValue(ctx, UberTraceID, r.Headers.Get(UberTraceID))
+	if key := r.Headers.Get(XIdempotencyKey); key != "" {
+		ctx = context.WithValue(ctx, XIdempotencyKey, key)
+	}
+	if r.subjectParams != nil {
+		ctx = context.WithValue(ctx, XSubjectParams, r.subjectParams)
+	}
 	logWithId := log.WithFields(logger, map[string]interface{}{"id": r.Headers.Get(XRequestId)})
 	ctx = context.WithValue(ctx, XLoggerId, logWithId)
 
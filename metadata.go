@@ -0,0 +1,46 @@
+package titan
+
+import (
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// metadataHeaders travel as native NATS headers next to the envelope headers,
+// so that non-titan tools (nats CLI, JetStream consumers, other languages) can read them.
+var metadataHeaders = []string{XRequestId, XOrigin, XUserInfo, UberTraceID}
+
+// encodeMsg encodes v with the connection codec, the metadata is copied into native headers
+// when the NATS server supports them.
+func encodeMsg(enc *nats.EncodedConn, subject, reply string, v interface{}, headers http.Header) (*nats.Msg, error) {
+	data, err := enc.Enc.Encode(subject, v)
+	if err != nil {
+		return nil, errors.WithMessage(err, "nats encoding error")
+	}
+	msg := &nats.Msg{Subject: subject, Reply: reply, Data: data}
+	if enc.Conn.HeadersSupported() {
+		for _, k := range metadataHeaders {
+			if v := headers.Get(k); v != "" {
+				if msg.Header == nil {
+					msg.Header = nats.Header{}
+				}
+				msg.Header.Set(k, v)
+			}
+		}
+	}
+	return msg, nil
+}
+
+// readMetadata prefers the native metadata headers over the embedded ones
+func readMetadata(headers http.Header, msg *nats.Msg) http.Header {
+	if headers == nil {
+		headers = http.Header{}
+	}
+	for _, k := range metadataHeaders {
+		if v := msg.Header.Get(k); v != "" {
+			headers.Set(k, v)
+		}
+	}
+	return headers
+}
@@ -0,0 +1,152 @@
+package titan
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"logur.dev/logur"
+)
+
+const MetricsPath = "/metrics"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "titan_requests_total",
+		Help: "Requests handled by subject, method, route pattern and status code.",
+	}, []string{"subject", "method", "route", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "titan_request_duration_seconds",
+		Help:    "Request handling latency by subject, method, route pattern and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"subject", "method", "route", "status"})
+
+	requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "titan_requests_in_flight",
+		Help: "Requests being handled by subject.",
+	}, []string{"subject"})
+
+	messageHandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "titan_message_handler_duration_seconds",
+		Help:    "Message subscriber handler latency by subject and result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"subject", "result"})
+
+	clientRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "titan_client_request_duration_seconds",
+		Help:    "Client call latency by destination subject, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"subject", "method", "status"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, requestsInFlight, messageHandlerDuration, clientRequestDuration)
+}
+
+// MetricsHandler serves the metrics of the default prometheus registry.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// observeRequest records the request in the request metrics, the route pattern is known once chi routed it
+func observeRequest(subject string, r *http.Request, statusCode int, elapsed time.Duration) {
+	route := ""
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		route = rctx.RoutePattern()
+	}
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	status := strconv.Itoa(statusCode)
+	requestsTotal.WithLabelValues(subject, r.Method, route, status).Inc()
+	requestDuration.WithLabelValues(subject, r.Method, route, status).Observe(elapsed.Seconds())
+}
+
+// observeMessageHandler records the handler latency of a message subscriber registration
+func observeMessageHandler(subject string, next MessageHandler) MessageHandler {
+	return func(m *Message) error {
+		t := time.Now()
+		err := next(m)
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		messageHandlerDuration.WithLabelValues(subject, result).Observe(time.Since(t).Seconds())
+		return err
+	}
+}
+
+func observeClientRequest(subject, method string, rp *Response, err error, elapsed time.Duration) {
+	status := "error"
+	if err == nil && rp != nil {
+		status = strconv.Itoa(rp.StatusCode)
+	}
+	clientRequestDuration.WithLabelValues(subject, method, status).Observe(elapsed.Seconds())
+}
+
+// requestCounts sums the handled requests, and the failed ones, of all subjects
+func requestCounts() (total uint64, failed uint64) {
+	metrics := make(chan prometheus.Metric, 64)
+	go func() {
+		requestsTotal.Collect(metrics)
+		close(metrics)
+	}()
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+		count := uint64(m.GetCounter().GetValue())
+		total += count
+		for _, label := range m.GetLabel() {
+			if label.GetName() != "status" {
+				continue
+			}
+			if code, _ := strconv.Atoi(label.GetValue()); code < 200 || code >= 300 {
+				failed += count
+			}
+		}
+	}
+	return total, failed
+}
+
+// requestsInFlightCount sums the requests being handled of all subjects
+func requestsInFlightCount() uint64 {
+	metrics := make(chan prometheus.Metric, 64)
+	go func() {
+		requestsInFlight.Collect(metrics)
+		close(metrics)
+	}()
+	var inFlight float64
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err == nil {
+			inFlight += m.GetGauge().GetValue()
+		}
+	}
+	return uint64(inFlight)
+}
+
+// serveMetrics serves the metrics on a standalone port, for services without restful.Server.
+// The port is listened on when it returns.
+func serveMetrics(logger logur.Logger, port string) (*http.Server, error) {
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, MetricsHandler())
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Error("Metrics server error", map[string]interface{}{"port": port, "err": err.Error()})
+		}
+	}()
+	return server, nil
+}
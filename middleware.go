@@ -50,6 +50,10 @@ func NewMiddleware(name string, subject string, logger logur.Logger) func(next h
 			origin := r.Header.Get(XOrigin)
 			ctx = context.WithValue(ctx, XOrigin, origin)
 
+			if key := r.Header.Get(XIdempotencyKey); key != "" {
+				ctx = context.WithValue(ctx, XIdempotencyKey, key)
+			}
+
 			//add user info
 			userInfoJson := r.Header.Get(XUserInfo)
 			if userInfoJson != "" {
@@ -68,7 +72,11 @@ func NewMiddleware(name string, subject string, logger logur.Logger) func(next h
 
 			rp := NewCustomResponseWriter(w)
 
+			inFlight := requestsInFlight.WithLabelValues(subject)
+			inFlight.Inc()
 			defer func() {
+				inFlight.Dec()
+				observeRequest(subject, r, rp.StatusCode, time.Since(t))
 				logWithId.Debug(name+" server request complete", map[string]interface{}{
 					"status":     rp.StatusCode,
 					"elapsed_ms": float64(time.Since(t).Nanoseconds()) / 1000000.0},
@@ -102,3 +110,9 @@ func (c *CustomResponseWriter) WriteHeader(statusCode int) {
 	c.w.WriteHeader(statusCode)
 	c.StatusCode = statusCode
 }
+
+func (c *CustomResponseWriter) Flush() {
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -18,10 +18,6 @@ const (
 	MONITORING_CHECK_REPLY = "monitoring_check_reply"
 )
 
-var msgInNum uint64
-var msgOutNum uint64
-var msgErrNum uint64
-
 var _monitoringSubscription *nats.Subscription
 
 type Monitoring struct {
@@ -39,8 +35,11 @@ type Monitoring struct {
 
 	NumGoroutine int `json:"numGoroutine"`
 
-	Pid int     `json:"pid"` // process id
-	Cpu float64 `json:"cpu"` // cpu usage
+	Pid     int     `json:"pid"`     // process id
+	Cpu     float64 `json:"cpu"`     // cpu usage over the last minute, in percent of one core
+	Rss     uint64  `json:"rss"`     // resident set size in bytes
+	OpenFds int     `json:"openFds"` // open file descriptors
+	Threads int     `json:"threads"` // OS threads
 
 	MsgInNum  uint64 `json:"msgInNum"`  // number of  in  messages
 	MsgOutNum uint64 `json:"msgOutNum"` // number of  out  messages
@@ -48,6 +47,8 @@ type Monitoring struct {
 
 	MsgPendingNum int `json:"msgPendingNum"` //pending message in queue
 
+	CircuitBreakers map[string]string `json:"circuitBreakers"` // circuit state by destination subject
+
 	Language    string `json:"language"`
 	RequestTime int64  `json:"requestTime"`
 }
@@ -67,6 +68,8 @@ func DoMonitoringCheck(subject string, m *Message) Monitoring {
 		}
 	}
 
+	outNum, errNum := requestCounts()
+
 	monitoring := Monitoring{
 		Status:   UP,
 		HostName: name,
@@ -86,29 +89,34 @@ func DoMonitoringCheck(subject string, m *Message) Monitoring {
 		NumGC:         rtm.NumGC,
 		NumGoroutine:  runtime.NumGoroutine(),
 		Language:      "Go",
-		MsgInNum:      atomic.LoadUint64(&msgInNum),
-		MsgOutNum:     atomic.LoadUint64(&msgOutNum),
-		MsgErrNum:     atomic.LoadUint64(&msgErrNum),
+		MsgInNum:      outNum + requestsInFlightCount() + atomic.LoadUint64(&msgInNum),
+		MsgOutNum:     outNum + atomic.LoadUint64(&msgOutNum),
+		MsgErrNum:     errNum + atomic.LoadUint64(&msgErrNum),
 		RequestTime:   time.Now().UnixNano() / int64(time.Millisecond),
 		MsgPendingNum: pendingMsg,
+
+		CircuitBreakers: CircuitBreakerStates(),
 	}
 
+	monitoring.Pid = process.pid
 	if err == nil {
-		monitoring.Pid = process.pid
 		monitoring.Cpu = process.cpu
+		monitoring.Rss = process.rss
+		monitoring.OpenFds = process.openFds
+		monitoring.Threads = process.threads
 	}
 
 	return monitoring
 }
 
+// BeginRequest warns about requests which waited too long before being handled,
+// request counts and latencies are recorded in the titan_requests metrics.
 func BeginRequest(logger logur.Logger, request RequestInterface) {
 	go func(logger logur.Logger, h http.Header) {
 		if r := recover(); r != nil {
 			logger.Info("BeginRequest panic recovered")
 		}
 
-		MsgInNumAdd(1)
-
 		// log  too high latency
 		requestTimeStr := h.Get(XRequestTime)
 
@@ -126,6 +134,12 @@ func BeginRequest(logger logur.Logger, request RequestInterface) {
 	}(logger, request.GetHeaders().Clone())
 }
 
+// counts of the deprecated MsgInNumAdd, MsgOutNumAdd and MsgErrNumAdd, added to the monitoring counts
+var msgInNum uint64
+var msgOutNum uint64
+var msgErrNum uint64
+
+// Deprecated: requests handled by titan servers are counted in the titan_requests metrics already.
 func EndRequest(logger logur.Logger, response ResponseInterface) {
 	go func(logger logur.Logger, response ResponseInterface) {
 		if r := recover(); r != nil {
@@ -138,6 +152,7 @@ func EndRequest(logger logur.Logger, response ResponseInterface) {
 	}(logger, response)
 }
 
+// Deprecated: requests handled by titan servers are counted in the titan_requests metrics already.
 func MsgInNumAdd(v uint64) {
 	if msgInNum >= 18446744073709551000 {
 		atomic.StoreUint64(&msgInNum, 0)
@@ -145,6 +160,7 @@ func MsgInNumAdd(v uint64) {
 	atomic.AddUint64(&msgInNum, v)
 }
 
+// Deprecated: requests handled by titan servers are counted in the titan_requests metrics already.
 func MsgOutNumAdd(v uint64) {
 	if msgOutNum >= 18446744073709551000 {
 		atomic.StoreUint64(&msgOutNum, 0)
@@ -152,6 +168,7 @@ func MsgOutNumAdd(v uint64) {
 	atomic.AddUint64(&msgOutNum, v)
 }
 
+// Deprecated: requests handled by titan servers are counted in the titan_requests metrics already.
 func MsgErrNumAdd(v uint64) {
 	if msgErrNum >= 18446744073709551000 {
 		atomic.StoreUint64(&msgErrNum, 0)
@@ -159,6 +176,7 @@ func MsgErrNumAdd(v uint64) {
 	atomic.AddUint64(&msgErrNum, v)
 }
 
+// Deprecated: use Server.Shutdown to wait for in-flight requests
 func MsgCountLoad() uint64 {
-	return atomic.LoadUint64(&msgInNum) - atomic.LoadUint64(&msgOutNum)
+	return requestsInFlightCount()
 }
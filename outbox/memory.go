@@ -0,0 +1,101 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryOutbox is an in-process Outbox with its own transactions, it is meant for tests and as reference implementation.
+type MemoryOutbox struct {
+	mux     sync.Mutex
+	pending []*Event
+}
+
+// MemoryTx collects the events of a MemoryOutbox until Commit.
+type MemoryTx struct {
+	outbox *MemoryOutbox
+	events []*Event
+	done   bool
+}
+
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{}
+}
+
+// Begin starts a transaction to Add events with.
+func (o *MemoryOutbox) Begin() *MemoryTx {
+	return &MemoryTx{outbox: o}
+}
+
+// Commit makes the events of the transaction pending.
+func (tx *MemoryTx) Commit() error {
+	tx.outbox.mux.Lock()
+	defer tx.outbox.mux.Unlock()
+	if tx.done {
+		return errors.New("outbox: transaction has already been committed or rolled back")
+	}
+	tx.done = true
+	tx.outbox.pending = append(tx.outbox.pending, tx.events...)
+	tx.events = nil
+	return nil
+}
+
+// Rollback drops the events of the transaction.
+func (tx *MemoryTx) Rollback() error {
+	tx.outbox.mux.Lock()
+	defer tx.outbox.mux.Unlock()
+	if tx.done {
+		return errors.New("outbox: transaction has already been committed or rolled back")
+	}
+	tx.done = true
+	tx.events = nil
+	return nil
+}
+
+func (o *MemoryOutbox) Add(ctx context.Context, tx Tx, events ...*Event) error {
+	memoryTx, ok := tx.(*MemoryTx)
+	if !ok || memoryTx.outbox != o {
+		return errors.Errorf("outbox: %T is not a transaction of this memory outbox", tx)
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if memoryTx.done {
+		return errors.New("outbox: transaction has already been committed or rolled back")
+	}
+	memoryTx.events = append(memoryTx.events, events...)
+	return nil
+}
+
+func (o *MemoryOutbox) Pending(ctx context.Context, limit int) ([]*Event, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	n := len(o.pending)
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	events := make([]*Event, n)
+	copy(events, o.pending)
+	return events, nil
+}
+
+func (o *MemoryOutbox) MarkSent(ctx context.Context, ids ...string) error {
+	sent := map[string]bool{}
+	for _, id := range ids {
+		sent[id] = true
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	pending := o.pending[:0]
+	for _, e := range o.pending {
+		if !sent[e.ID] {
+			pending = append(pending, e)
+		}
+	}
+	for i := len(pending); i < len(o.pending); i++ {
+		o.pending[i] = nil
+	}
+	o.pending = pending
+	return nil
+}
@@ -0,0 +1,70 @@
+// Package outbox publishes events reliably with the transactional outbox pattern.
+// Events are stored in the same transaction as the business data and published afterwards by a Relay,
+// so an event is never lost when the process dies between the commit and the publish.
+// The Relay publishes at least once, subscribers can skip duplicates by the Idempotency-Key of the event.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"gitlab.com/silenteer-oss/titan"
+)
+
+// Event is a message waiting in the outbox to be published.
+type Event struct {
+	ID        string      `json:"id"`
+	Subject   string      `json:"subject"`
+	Headers   http.Header `json:"headers"`
+	Body      []byte      `json:"body"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+// Tx is the transaction the events are stored with, e.g. a *sql.Tx for a SQL outbox.
+type Tx interface{}
+
+// Outbox stores the events until they are published.
+// A SQL implementation inserts the events with the transaction of the business data in Add,
+// selects the unsent events ordered by creation in Pending and flags them sent in MarkSent.
+type Outbox interface {
+	// Add stores the events in tx, they become pending when tx commits
+	Add(ctx context.Context, tx Tx, events ...*Event) error
+	// Pending returns up to limit committed events which are not sent yet, oldest first
+	Pending(ctx context.Context, limit int) ([]*Event, error)
+	// MarkSent removes the events from the pending ones
+	MarkSent(ctx context.Context, ids ...string) error
+}
+
+// NewEvent creates an event carrying the request id, origin, user and trace of ctx, like Client.Publish.
+// Its id is the Idempotency-Key of the message, so every event of a request is handled once.
+func NewEvent(ctx *titan.Context, subject string, body interface{}) (*Event, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.WithMessage(err, "outbox event json encoding error")
+	}
+
+	id := uuid.New().String()
+	headers := http.Header{}
+	headers.Set(titan.XRequestId, ctx.RequestId())
+	headers.Set(titan.XOrigin, ctx.Origin())
+	headers.Set(titan.XUserInfo, ctx.UserInfoJson())
+	headers.Set(titan.UberTraceID, ctx.UberTraceID())
+	headers.Set(titan.XIdempotencyKey, id)
+
+	return &Event{
+		ID:        id,
+		Subject:   subject,
+		Headers:   headers,
+		Body:      b,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func (e *Event) message() *titan.Message {
+	return &titan.Message{Headers: e.Headers.Clone(), Body: e.Body}
+}
@@ -0,0 +1,103 @@
+package outbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/silenteer-oss/titan"
+	"gitlab.com/silenteer-oss/titan/outbox"
+)
+
+type OrderCreated struct {
+	OrderId string `json:"orderId"`
+}
+
+// flakyConnection fails the first publishes
+type flakyConnection struct {
+	*titan.MemoryConnection
+	mux      sync.Mutex
+	failures int
+}
+
+func (c *flakyConnection) Publish(subject string, v interface{}) error {
+	c.mux.Lock()
+	if c.failures > 0 {
+		c.failures--
+		c.mux.Unlock()
+		return errors.New("nats: connection closed")
+	}
+	c.mux.Unlock()
+	return c.MemoryConnection.Publish(subject, v)
+}
+
+func TestRelay(t *testing.T) {
+	conn := &flakyConnection{MemoryConnection: titan.NewMemoryConnection(), failures: 2}
+	var mux sync.Mutex
+	var received []*titan.Message
+	_, err := conn.Subscribe("orders.created", func(m *titan.Message) {
+		mux.Lock()
+		defer mux.Unlock()
+		received = append(received, m)
+	})
+	require.NoError(t, err)
+
+	store := outbox.NewMemoryOutbox()
+	// the events of a request with an Idempotency-Key get their own keys
+	ctx := titan.NewContext(context.WithValue(context.Background(), titan.XIdempotencyKey, "request-1"))
+	add := func(orderId string) *outbox.MemoryTx {
+		event, err := outbox.NewEvent(ctx, "orders.created", OrderCreated{OrderId: orderId})
+		require.NoError(t, err)
+		tx := store.Begin()
+		require.NoError(t, store.Add(ctx, tx, event))
+		return tx
+	}
+
+	//1. only committed events are pending
+	require.NoError(t, add("1").Commit())
+	require.NoError(t, add("2").Rollback())
+	require.NoError(t, add("3").Commit())
+	pending, err := store.Pending(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+
+	//2. publishing fails after all attempts, the events stay pending
+	relay := outbox.NewRelay(store, conn, outbox.Retries(2, time.Millisecond))
+	sent, err := relay.Flush(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 0, sent)
+	pending, _ = store.Pending(ctx, 0)
+	assert.Len(t, pending, 2)
+
+	//3. the background relay publishes them in order
+	relay = outbox.NewRelay(store, conn, outbox.Interval(10*time.Millisecond), outbox.BatchSize(1))
+	require.NoError(t, relay.Start(context.Background()))
+	require.NoError(t, add("4").Commit())
+	assert.Eventually(t, func() bool {
+		pending, _ := store.Pending(ctx, 0)
+		return len(pending) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, relay.Stop(context.Background()))
+
+	mux.Lock()
+	defer mux.Unlock()
+	var orderIds []string
+	keys := map[string]bool{}
+	for _, m := range received {
+		var order OrderCreated
+		require.NoError(t, json.Unmarshal(m.Body, &order))
+		orderIds = append(orderIds, order.OrderId)
+		keys[m.Headers.Get(titan.XIdempotencyKey)] = true
+		assert.Equal(t, ctx.RequestId(), m.Headers.Get(titan.XRequestId))
+	}
+	assert.Equal(t, []string{"1", "3", "4"}, orderIds)
+	assert.Len(t, keys, 3)
+	assert.NotContains(t, keys, "request-1")
+	assert.NotContains(t, keys, "")
+}
@@ -0,0 +1,190 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"logur.dev/logur"
+
+	"gitlab.com/silenteer-oss/titan"
+)
+
+const (
+	defaultInterval    = time.Second
+	defaultBatchSize   = 100
+	defaultMaxAttempts = 3
+	defaultBackoff     = 100 * time.Millisecond
+)
+
+// Relay publishes the pending events of an outbox in the background, in the order they were committed.
+// An event which cannot be published after all attempts stops the batch, it is retried on the next poll.
+type Relay struct {
+	outbox      Outbox
+	conn        titan.IConnection
+	logger      logur.Logger
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+	backoff     time.Duration
+
+	mux  sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+type RelayOption func(*Relay)
+
+// Interval sets how often the outbox is polled for pending events, default 1s.
+func Interval(d time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.interval = d
+	}
+}
+
+// BatchSize limits the events read from the outbox at once, default 100.
+func BatchSize(size int) RelayOption {
+	return func(r *Relay) {
+		r.batchSize = size
+	}
+}
+
+// Retries sets the publish attempts of an event and the wait before the second one, doubled after every attempt.
+func Retries(maxAttempts int, backoff time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.maxAttempts = maxAttempts
+		r.backoff = backoff
+	}
+}
+
+func Logger(logger logur.Logger) RelayOption {
+	return func(r *Relay) {
+		r.logger = logger
+	}
+}
+
+// NewRelay creates a relay publishing the events of outbox with conn, e.g. a titan.NewConnection.
+// Its Start and Stop fit the server lifecycle hooks:
+//
+//	titan.NewServer(subject, titan.OnStarted(relay.Start), titan.OnStopping(relay.Stop))
+func NewRelay(outbox Outbox, conn titan.IConnection, opts ...RelayOption) *Relay {
+	r := &Relay{
+		outbox:      outbox,
+		conn:        conn,
+		logger:      titan.GetLogger(),
+		interval:    defaultInterval,
+		batchSize:   defaultBatchSize,
+		maxAttempts: defaultMaxAttempts,
+		backoff:     defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.maxAttempts < 1 {
+		r.maxAttempts = 1
+	}
+	return r
+}
+
+// Start polls the outbox in the background until Stop.
+func (r *Relay) Start(ctx context.Context) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.stop != nil {
+		return errors.New("outbox relay is already started")
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(r.stop, r.done)
+	return nil
+}
+
+// Stop cancels the retries in progress and waits for the relay to return, or until ctx is done.
+func (r *Relay) Stop(ctx context.Context) error {
+	r.mux.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mux.Unlock()
+	if stop == nil {
+		return nil
+	}
+
+	close(stop)
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.WithMessage(ctx.Err(), "outbox relay stop error")
+	}
+}
+
+func (r *Relay) run(stop, done chan struct{}) {
+	defer close(done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-done:
+		}
+	}()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Flush(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Error("Outbox relay error", map[string]interface{}{"err": err.Error()})
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush publishes the pending events now and returns how many were sent.
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	sent := 0
+	for {
+		events, err := r.outbox.Pending(ctx, r.batchSize)
+		if err != nil {
+			return sent, errors.WithMessage(err, "outbox pending events error")
+		}
+		for _, e := range events {
+			if err := r.publish(ctx, e); err != nil {
+				return sent, err
+			}
+			if err := r.outbox.MarkSent(ctx, e.ID); err != nil {
+				return sent, errors.WithMessagef(err, "outbox mark sent error, event %s", e.ID)
+			}
+			sent++
+		}
+		if len(events) == 0 || len(events) < r.batchSize {
+			return sent, nil
+		}
+	}
+}
+
+func (r *Relay) publish(ctx context.Context, e *Event) error {
+	wait := r.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = r.conn.Publish(e.Subject, e.message()); err == nil {
+			return nil
+		}
+		if attempt >= r.maxAttempts {
+			break
+		}
+		r.logger.Warn("Outbox publish retry", map[string]interface{}{"event": e.ID, "subject": e.Subject, "attempt": attempt, "err": err.Error()})
+		select {
+		case <-ctx.Done():
+			return errors.WithMessagef(ctx.Err(), "outbox publish canceled, event %s", e.ID)
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+	return errors.WithMessagef(err, "outbox publish error after %d attempts, event %s to %s", r.maxAttempts, e.ID, e.Subject)
+}
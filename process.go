@@ -1,57 +1,254 @@
 package titan
 
 import (
-	"bytes"
-	"fmt"
+	"bufio"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	processSampleInterval = 5 * time.Second
+	processSampleWindow   = time.Minute
+
+	// USER_HZ, the unit of the CPU times in /proc/<pid>/stat, is 100 on all Linux platforms
+	clockTicksPerSecond = 100
 )
 
+var errProcessStatsUnavailable = errors.New("process statistics are not available, /proc is missing")
+
 type Process struct {
-	pid int
-	cpu float64
+	pid     int
+	cpu     float64 // percent of one core over the sample window
+	rss     uint64  // resident set size in bytes
+	openFds int
+	threads int
 }
 
 var pid int
 
 func init() {
 	pid = os.Getpid()
+
+	prometheus.MustRegister(processCollector{})
 }
 
+// GetCpuUsage returns the process statistics sampled from /proc every 5 seconds, the CPU usage is averaged
+// over the last minute. The sampler starts with the first call, see StopProcessSampler.
+// Systems without /proc get the pid only and an error.
 func GetCpuUsage() (*Process, error) {
-	cmd := exec.Command("ps", "aux", strconv.Itoa(pid))
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	sampler.start()
+	return sampler.process()
+}
+
+// StopProcessSampler stops reading /proc, the next GetCpuUsage or metrics scrape starts it again.
+func StopProcessSampler() {
+	sampler.stop()
+}
+
+var (
+	processCpuDesc = prometheus.NewDesc("titan_process_cpu_usage_percent",
+		"CPU usage of the process over the last minute, in percent of one core.", nil, nil)
+	processThreadsDesc = prometheus.NewDesc("titan_process_threads",
+		"OS threads of the process.", nil, nil)
+	processRssDesc = prometheus.NewDesc("titan_process_resident_memory_bytes",
+		"Resident set size of the process in bytes.", nil, nil)
+	processOpenFdsDesc = prometheus.NewDesc("titan_process_open_fds",
+		"Open file descriptors of the process.", nil, nil)
+)
+
+// processCollector reports the latest process statistics of the sampler when the metrics are scraped
+type processCollector struct{}
+
+func (processCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- processCpuDesc
+	ch <- processThreadsDesc
+	ch <- processRssDesc
+	ch <- processOpenFdsDesc
+}
+
+func (processCollector) Collect(ch chan<- prometheus.Metric) {
+	p, err := GetCpuUsage()
 	if err != nil {
-		return nil, err
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(processCpuDesc, prometheus.GaugeValue, p.cpu)
+	ch <- prometheus.MustNewConstMetric(processThreadsDesc, prometheus.GaugeValue, float64(p.threads))
+	ch <- prometheus.MustNewConstMetric(processRssDesc, prometheus.GaugeValue, float64(p.rss))
+	ch <- prometheus.MustNewConstMetric(processOpenFdsDesc, prometheus.GaugeValue, float64(p.openFds))
+}
+
+type cpuSample struct {
+	at  time.Time
+	cpu float64 // user and system CPU seconds since the process started
+}
+
+// processSampler reads /proc/self periodically and keeps the CPU samples of the window in a ring buffer
+type processSampler struct {
+	runMux  sync.Mutex    // guards starting and stopping
+	done    chan struct{} // closed to stop the sampling, nil while not running
+	mux     sync.RWMutex
+	samples [processSampleWindow/processSampleInterval + 1]cpuSample
+	next    int // index of the next sample
+	count   int // samples in the buffer
+	stats   Process
+	err     error
+}
+
+var sampler = &processSampler{}
+
+func (s *processSampler) start() {
+	s.runMux.Lock()
+	defer s.runMux.Unlock()
+	if s.done != nil {
+		return
 	}
+	s.done = make(chan struct{})
 
-	for {
-		line, err := out.ReadString('\n')
-		if err != nil {
-			break
-		}
-		tokens := strings.Split(line, " ")
-		ft := make([]string, 0)
-		for _, t := range tokens {
-			if t != "" && t != "\t" {
-				ft = append(ft, t)
+	// the first sample is taken right away, so the statistics are there for the first reader
+	s.sample()
+	if s.sampleErr() == errProcessStatsUnavailable {
+		return
+	}
+	go func(done chan struct{}) {
+		ticker := time.NewTicker(processSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sample()
+			case <-done:
+				return
 			}
 		}
-		id, err := strconv.Atoi(ft[1])
-		if err != nil {
-			continue
+	}(s.done)
+}
+
+func (s *processSampler) stop() {
+	s.runMux.Lock()
+	defer s.runMux.Unlock()
+	if s.done == nil {
+		return
+	}
+	close(s.done)
+	s.done = nil
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.next, s.count = 0, 0
+}
+
+func (s *processSampler) sampleErr() error {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.err
+}
+
+func (s *processSampler) process() (*Process, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	p := s.stats
+	p.pid = pid
+	if s.count > 1 {
+		size := len(s.samples)
+		first, last := s.samples[(s.next-s.count+size)%size], s.samples[(s.next-1+size)%size]
+		if elapsed := last.at.Sub(first.at).Seconds(); elapsed > 0 {
+			p.cpu = (last.cpu - first.cpu) / elapsed * 100
 		}
-		cpu, err := strconv.ParseFloat(ft[2], 64)
-		if err != nil {
-			return nil, err
+	}
+	return &p, s.err
+}
+
+func (s *processSampler) sample() {
+	now := time.Now()
+	cpu, err := readProcStat()
+	var stats Process
+	if err == nil {
+		stats, err = readProcStatus()
+	}
+	if err == nil {
+		stats.openFds, err = countOpenFds()
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.err = err
+	if err != nil {
+		return
+	}
+	s.stats = stats
+	s.samples[s.next] = cpuSample{at: now, cpu: cpu}
+	s.next = (s.next + 1) % len(s.samples)
+	if s.count < len(s.samples) {
+		s.count++
+	}
+}
+
+// readProcStat returns the user and system CPU seconds of the process
+func readProcStat() (float64, error) {
+	data, err := ioutil.ReadFile("/proc/self/stat")
+	if os.IsNotExist(err) {
+		return 0, errProcessStatsUnavailable
+	}
+	if err != nil {
+		return 0, errors.WithMessage(err, "reading /proc/self/stat error")
+	}
+	// the command name may contain spaces, the fields after it start with the state (field 3)
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 13 {
+		return 0, errors.Errorf("unexpected /proc/self/stat format: %s", stat)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, errors.WithMessage(err, "parsing utime error")
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, errors.WithMessage(err, "parsing stime error")
+	}
+	return float64(utime+stime) / clockTicksPerSecond, nil
+}
+
+// readProcStatus reads the resident set size and the threads of the process
+func readProcStatus() (Process, error) {
+	var p Process
+	f, err := os.Open("/proc/self/status")
+	if os.IsNotExist(err) {
+		return p, errProcessStatsUnavailable
+	}
+	if err != nil {
+		return p, errors.WithMessage(err, "reading /proc/self/status error")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
 		}
-		if id == pid {
-			return &Process{pid, cpu}, nil
+		switch fields[0] {
+		case "VmRSS:": // in kB
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			p.rss = kb * 1024
+		case "Threads:":
+			p.threads, _ = strconv.Atoi(fields[1])
 		}
 	}
-	return nil, fmt.Errorf("process not found  %d", pid)
+	return p, scanner.Err()
+}
+
+func countOpenFds() (int, error) {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, errors.WithMessage(err, "reading /proc/self/fd error")
+	}
+	return len(fds), nil
 }
@@ -0,0 +1,83 @@
+package titan
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// XReplyError carries the handler error of a reply, see Client.RequestMessage.
+const XReplyError = "X-Reply-Error"
+
+// ReplyHandler handles a message and returns the reply to its sender.
+type ReplyHandler func(*Message) (interface{}, error)
+
+// RegisterReply registers a handler whose result, or error, is sent back to the sender, see Client.RequestMessage.
+// Messages published without a reply inbox are handled like events.
+func (s *MessageSubscriber) RegisterReply(subject string, queue string, handler ReplyHandler, opts ...RegistrationOption) {
+	s.Register(subject, queue, func(m *Message) error {
+		// a panicking handler is answered with its error too
+		var v interface{}
+		err := s.createHandlerWithRecover(func(m *Message) (err error) {
+			v, err = handler(m)
+			return err
+		})(m)
+		if m.Reply != "" {
+			s.reply(m, v, err)
+		}
+		return err
+	}, opts...)
+}
+
+// reply publishes the result encoded like the message to its reply inbox
+func (s *MessageSubscriber) reply(m *Message, v interface{}, cause error) {
+	rp := &Message{Headers: http.Header{}}
+	rp.Headers.Set(XRequestId, m.Headers.Get(XRequestId))
+	if cause == nil && v != nil {
+		codec := responseCodec(m.Headers)
+		body, err := codec.Marshal(v)
+		if err != nil {
+			cause = errors.WithMessage(err, "reply encoding error")
+		} else {
+			rp.Body = body
+			rp.Headers.Set(contentType, codec.ContentType())
+		}
+	}
+	if cause != nil {
+		rp.Headers.Set(XReplyError, cause.Error())
+	}
+
+	msg, err := newMessageMsg(s.conn, m.Reply, rp)
+	if err == nil {
+		err = s.conn.Conn.PublishMsg(msg)
+	}
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Nats message reply error: %+v\n ", err))
+	}
+}
+
+// RequestMessage sends the body as a message to a handler registered with MessageSubscriber.RegisterReply,
+// or with MessageSubscriber.RegisterJson returning a result, and decodes the reply into receive.
+// The handler error is returned when the handler failed.
+func (srv *Client) RequestMessage(ctx *Context, subject string, body interface{}, receive interface{}) error {
+	r, ok := srv.conn.(MessageRequester)
+	if !ok {
+		return errNotSupported(srv.conn, "message requests")
+	}
+	var reply *Message
+	err := srv.publish(ctx, subject, body, func(m *Message) (err error) {
+		reply, err = r.RequestMessage(ctx, subject, m)
+		return err
+	})
+	if err != nil {
+		return errors.WithMessage(err, "nats message request error")
+	}
+	if cause := reply.Headers.Get(XReplyError); cause != "" {
+		return errors.New(cause)
+	}
+	if receive == nil || len(reply.Body) == 0 {
+		return nil
+	}
+	return requestCodec(reply.Headers).Unmarshal(reply.Body, receive)
+}
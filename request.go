@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -19,15 +20,26 @@ const (
 	XLoggerId          = "X-LOGGER-ID"
 	XPathParams        = "X-PATH-PARAMS"
 	XQueryParams       = "X-QUERY-PARAMS"
+	XSubjectParams     = "X-SUBJECT-PARAMS"
 	XRequest           = "X-REQUEST"
+	XRequestBody       = "X-REQUEST-BODY"   // unread body of handlers taking an io.Reader
 	XUserInfo          = "X-Silentium-User" // how to remove this value
 	XGlobalCache       = "X-Global-Cache"   // how to remove this value
 	UberTraceID        = "Uber-Trace-Id"
 	contentType        = "Content-Type"
 	jsonContentType    = "application/json"
 	XRequestTime       = "X-Request-Time"
+	XRequestTimeout    = "X-Request-Timeout" // remaining caller deadline in milliseconds
 	XResponeTime       = "X-Response-Time"
 	XOrigin            = "X-Origin"
+	XHostname          = "X-Hostname"      // hostname of the responding server instance
+	XStream            = "X-Stream"        // the client reads the response as ordered chunks
+	XStreamWindow      = "X-Stream-Window" // chunks the server may send ahead of the client acknowledgements
+	XStreamSeq         = "X-Stream-Seq"
+	XStreamEnd         = "X-Stream-End"
+	XStreamError       = "X-Stream-Error"
+	XUpload            = "X-Upload" // the client streams the request body, see Client.SendUploadRequest
+	XUploadInbox       = "X-Upload-Inbox"
 )
 
 type RequestInterface interface {
@@ -46,6 +58,9 @@ type Request struct {
 
 	// in case of using NATS subject instead of Restful url prefix
 	Subject string `json:"subject"`
+
+	// client side latency budget, it is sent to the server as the remaining deadline
+	Timeout time.Duration `json:"-"`
 }
 
 func (r *Request) GetUrl() string {
@@ -109,6 +124,8 @@ type RequestBuilder struct {
 	rawURL string
 
 	subject string
+
+	timeout time.Duration
 }
 
 // New returns a new default  Request.
@@ -233,6 +250,14 @@ func (r *RequestBuilder) BodyJSON(bodyJSON interface{}) *RequestBuilder {
 	return r.BodyProvider(jsonBodyProvider{payload: bodyJSON})
 }
 
+// BodyCodec encodes the body with the codec and sets its Content-Type, e.g. BodyCodec(ProtobufCodec, msg)
+func (r *RequestBuilder) BodyCodec(codec Codec, body interface{}) *RequestBuilder {
+	if body == nil {
+		return r
+	}
+	return r.BodyProvider(codecBodyProvider{codec: codec, payload: body})
+}
+
 func (r *RequestBuilder) AddHeaders(header http.Header) *RequestBuilder {
 	for key, values := range header {
 		for _, value := range values {
@@ -247,11 +272,23 @@ func (r *RequestBuilder) SetHeaders(header http.Header) *RequestBuilder {
 	return r
 }
 
+// IdempotencyKey lets the server answer a repeated request with the response of the first one,
+// the keys are scoped by user, requests without one are not deduplicated.
+func (r *RequestBuilder) IdempotencyKey(key string) *RequestBuilder {
+	return r.SetHeader(XIdempotencyKey, key)
+}
+
 func (r *RequestBuilder) Subject(subject string) *RequestBuilder {
 	r.subject = subject
 	return r
 }
 
+// Timeout sets how long the client waits for the response of this request.
+func (r *RequestBuilder) Timeout(timeout time.Duration) *RequestBuilder {
+	r.timeout = timeout
+	return r
+}
+
 func (r *RequestBuilder) Build() (*Request, error) {
 	_, err := url.Parse(r.rawURL)
 	if err != nil {
@@ -264,7 +301,7 @@ func (r *RequestBuilder) Build() (*Request, error) {
 			return nil, errors.WithMessage(err, "Invalid body format ")
 		}
 	}
-	return &Request{URL: r.rawURL, Method: r.method, Headers: r.headers, Body: body, Subject: r.subject}, nil
+	return &Request{URL: r.rawURL, Method: r.method, Headers: r.headers, Body: body, Subject: r.subject, Timeout: r.timeout}, nil
 }
 
 func NatsRequestToHttpRequest(rq *Request) (*http.Request, error) {
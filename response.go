@@ -16,6 +16,9 @@ type Response struct {
 	StatusCode int         `json:"code"`   // e.g. 200
 	Headers    http.Header `json:"headers"`
 	Body       []byte      `json:"body"`
+
+	// Stream writes the body instead of Body when it is set, see ResponseBuilder.Stream
+	Stream StreamFunc `json:"-"`
 }
 
 func (r *Response) GetBody() []byte {
@@ -33,7 +36,7 @@ func (r *Response) Header() http.Header {
 
 //Deprecated: please  use response builder instead
 func (r *Response) Write(b []byte) (n int, err error) {
-	r.Body = b
+	r.Body = append(r.Body, b...)
 	//r.WriteHeader(http.StatusOK)
 	return len(b), nil
 }
@@ -59,6 +62,8 @@ type ResponseBuilder struct {
 	headers http.Header
 
 	bodyProvider BodyProvider
+
+	stream StreamFunc
 }
 
 // New returns a new default  Request.
@@ -101,6 +106,13 @@ func (r *ResponseBuilder) Body(body []byte) *ResponseBuilder {
 	return r.BodyProvider(byteBodyProvider{body: body})
 }
 
+// Stream sets a function writing the body in chunks, for large payloads which should not be held in memory.
+func (r *ResponseBuilder) Stream(contentType string, stream StreamFunc) *ResponseBuilder {
+	r.SetContentType(contentType)
+	r.stream = stream
+	return r
+}
+
 func (r *ResponseBuilder) StatusCode(status int) *ResponseBuilder {
 	r.statusCode = status
 	return r
@@ -128,6 +140,14 @@ func (r *ResponseBuilder) BodyJSON(bodyJSON interface{}) *ResponseBuilder {
 	return r.BodyProvider(jsonBodyProvider{payload: bodyJSON})
 }
 
+// BodyCodec encodes the body with the codec and sets its Content-Type, e.g. BodyCodec(ProtobufCodec, msg)
+func (r *ResponseBuilder) BodyCodec(codec Codec, body interface{}) *ResponseBuilder {
+	if body == nil {
+		return r
+	}
+	return r.BodyProvider(codecBodyProvider{codec: codec, payload: body})
+}
+
 func (r *ResponseBuilder) Build() *Response {
 	var body []byte
 	var err error
@@ -137,5 +157,5 @@ func (r *ResponseBuilder) Build() *Response {
 			return &Response{StatusCode: 500, Headers: r.headers, Body: []byte("Invalid body return")}
 		}
 	}
-	return &Response{StatusCode: r.statusCode, Headers: r.headers, Body: body}
+	return &Response{StatusCode: r.statusCode, Headers: r.headers, Body: body, Stream: r.stream}
 }
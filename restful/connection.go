@@ -1,8 +1,11 @@
 package restful
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -44,32 +47,53 @@ func NewConnection(discovery Discovery) titan.IConnection {
 }
 
 func (c *Connection) SendRequest(rq *titan.Request, subject string) (*titan.Response, error) {
-	request, err := titan.NatsRequestToHttpRequest(rq)
+	return c.SendRequestWithContext(context.Background(), rq, subject)
+}
+
+func (c *Connection) SendRequestWithContext(ctx context.Context, rq *titan.Request, subject string) (*titan.Response, error) {
+	response, err := c.do(ctx, rq, subject, nil)
 	if err != nil {
 		return nil, err
 	}
-	request.Header.Del("application/json")
 
-	add, err := c.discovery.LookupService(subject)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	urlString := fmt.Sprintf("%s/%s", strings.TrimSuffix(add, "/"), strings.TrimPrefix(rq.URL, "/"))
-	u, err := url.Parse(urlString)
+	return &titan.Response{
+		Status:     response.Status,
+		StatusCode: response.StatusCode,
+		Headers:    response.Header,
+		Body:       body,
+	}, nil
+}
+
+// SendStreamRequest returns the http response body as it arrives, chunked transfer encoding included.
+func (c *Connection) SendStreamRequest(ctx context.Context, rq *titan.Request, subject string) (*titan.ResponseStream, error) {
+	response, err := c.do(ctx, rq, subject, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	request.URL = u
+	return &titan.ResponseStream{
+		Status:     response.Status,
+		StatusCode: response.StatusCode,
+		Headers:    response.Header,
+		Body:       response.Body,
+	}, nil
+}
 
-	response, err := c.client.Do(request)
+// SendUploadRequest sends body as the http request body with chunked transfer encoding.
+func (c *Connection) SendUploadRequest(ctx context.Context, rq *titan.Request, subject string, body io.Reader) (*titan.Response, error) {
+	response, err := c.do(ctx, rq, subject, body)
 	if err != nil {
 		return nil, err
 	}
 
 	defer response.Body.Close()
-	body, err := ioutil.ReadAll(response.Body)
+	rpBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return nil, err
 	}
@@ -78,15 +102,60 @@ func (c *Connection) SendRequest(rq *titan.Request, subject string) (*titan.Resp
 		Status:     response.Status,
 		StatusCode: response.StatusCode,
 		Headers:    response.Header,
-		Body:       body,
+		Body:       rpBody,
 	}, nil
 }
 
+func (c *Connection) do(ctx context.Context, rq *titan.Request, subject string, body io.Reader) (*http.Response, error) {
+	request, err := titan.NatsRequestToHttpRequest(rq)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	if body != nil {
+		request.Body = ioutil.NopCloser(body)
+		request.ContentLength = -1
+	}
+	request.Header.Del("application/json")
+
+	add, err := c.discovery.LookupService(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	urlString := fmt.Sprintf("%s/%s", strings.TrimSuffix(add, "/"), strings.TrimPrefix(rq.URL, "/"))
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return nil, err
+	}
+
+	request.URL = u
+
+	return c.client.Do(request)
+}
+
+// ScatterGather returns the single reply of the discovered http service.
+func (c *Connection) ScatterGather(ctx context.Context, rq *titan.Request, subject string, maxReplies int) ([]*titan.Response, error) {
+	rp, err := c.SendRequestWithContext(ctx, rq, subject)
+	if err != nil {
+		return nil, err
+	}
+	return []*titan.Response{rp}, nil
+}
+
 func (c *Connection) Publish(subject string, v interface{}) error {
 	log.Error("Not implemented http Publish")
 	return nil
 }
 
+func (c *Connection) PublishPersistent(subject string, m *titan.Message) (uint64, error) {
+	return 0, errors.New("Not implemented http PublishPersistent")
+}
+
+func (c *Connection) RequestMessage(ctx context.Context, subject string, m *titan.Message) (*titan.Message, error) {
+	return nil, errors.New("Not implemented http RequestMessage")
+}
+
 func (c *Connection) Flush() error {
 	return nil
 }
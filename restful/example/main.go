@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -37,5 +38,8 @@ func main() {
 		restful.Static("document", resourcePath),
 	)
 
-	server.Start()
+	if err := server.Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -4,10 +4,12 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -115,8 +117,11 @@ func Static(path, directory string) Option {
 	}
 }
 
+var metricsHandler = titan.MetricsHandler()
+
 type IServer interface {
 	Stop()
+	Shutdown(ctx context.Context) error
 	Start(started ...chan interface{})
 }
 
@@ -129,7 +134,10 @@ type Server struct {
 	port          string
 	handler       http.Handler // handler to invoke, http.DefaultServeMux if nil
 	logger        logur.Logger
-	stop          chan interface{}
+	mux           sync.Mutex // guards the run state below
+	stop          chan context.Context
+	stopped       chan struct{} // closed when the server has stopped
+	stopErr       error
 	socketManager *socket.SocketManager
 	socketHandler map[string]socket.HandlerFunc
 	statics       map[string]string // Serve static files
@@ -193,7 +201,13 @@ func NewServer(options ...Option) *Server {
 		//"key":          opts.tlsKey,
 	})
 
+	// not running, Shutdown returns at once
+	stopped := make(chan struct{})
+	close(stopped)
+
 	srv := &Server{
+		stop:          make(chan context.Context, 1),
+		stopped:       stopped,
 		tlsEnable:     opts.tlsEnable,
 		tlsKey:        opts.tlsKey,
 		tlsCert:       opts.tlsCert,
@@ -222,15 +236,56 @@ func NewServer(options ...Option) *Server {
 	return srv
 }
 
+// Start runs the server until it is stopped, see Run. The start error is logged.
 func (srv *Server) Start(started ...chan interface{}) {
+	err := srv.Run(started...)
+	if err != nil {
+		srv.logger.Error(fmt.Sprintf("Http server start error: %+v\n ", err))
+	}
+}
+
+// Run runs the server until it is stopped. It returns the error which prevented the server
+// from starting, the started channels receive it instead of true.
+func (srv *Server) Run(started ...chan interface{}) error {
 	err := srv.start(started...)
 	if err != nil {
-		srv.logger.Error(fmt.Sprintf("Nats server start error: %+v\n ", err))
-		os.Exit(1)
+		for i := range started {
+			started[i] <- err
+		}
+	}
+	return err
+}
+
+// beginRun marks the server running, the returned channel receives the context of Shutdown
+func (srv *Server) beginRun() (chan context.Context, error) {
+	srv.mux.Lock()
+	defer srv.mux.Unlock()
+	select {
+	case <-srv.stopped:
+	default:
+		return nil, errors.New("server is already running")
 	}
+	srv.stop = make(chan context.Context, 1)
+	srv.stopped = make(chan struct{})
+	srv.stopErr = nil
+	return srv.stop, nil
+}
+
+func (srv *Server) endRun(stopErr error) {
+	srv.mux.Lock()
+	defer srv.mux.Unlock()
+	srv.stopErr = stopErr
+	close(srv.stopped)
 }
 
 func (srv *Server) start(started ...chan interface{}) (err error) {
+	stop, err := srv.beginRun()
+	if err != nil {
+		return err
+	}
+	var stopErr error
+	defer func() { srv.endRun(stopErr) }()
+
 	var server *http.Server
 	var tlsConfig *tls.Config
 
@@ -262,6 +317,36 @@ func (srv *Server) start(started ...chan interface{}) (err error) {
 		}
 	}
 
+	server = &http.Server{
+		Handler: srv.handler,
+		// Other options
+	}
+
+	// use proxy instead
+	//if srv.socketManager != nil {
+	server.Handler = srv
+	//}
+
+	if srv.port != "" {
+		server.Addr = ":" + srv.port
+	}
+	if srv.tlsEnable {
+		server.TLSConfig = tlsConfig
+	}
+
+	// requests are accepted once the started channels are signaled
+	addr := server.Addr
+	if addr == "" {
+		addr = ":http"
+		if srv.tlsEnable {
+			addr = ":https"
+		}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.WithMessage(err, "cannot listen")
+	}
+
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
@@ -275,31 +360,17 @@ func (srv *Server) start(started ...chan interface{}) (err error) {
 			}
 		}()
 
-		server = &http.Server{
-			Handler: srv.handler,
-			// Other options
-		}
-
-		// use proxy instead
-		//if srv.socketManager != nil {
-		server.Handler = srv
-		//}
-
-		if srv.port != "" {
-			server.Addr = ":" + srv.port
-		}
-
 		for i := range started {
 			started[i] <- true
 		}
 
 		srv.logger.Info("Http server started")
 
+		var err error
 		if srv.tlsEnable {
-			server.TLSConfig = tlsConfig
-			err = server.ListenAndServeTLS("", "")
+			err = server.ServeTLS(listener, "", "")
 		} else {
-			err = server.ListenAndServe()
+			err = server.Serve(listener)
 		}
 
 		if err != nil && err != http.ErrServerClosed {
@@ -314,11 +385,11 @@ func (srv *Server) start(started ...chan interface{}) (err error) {
 	// Handle SIGINT and SIGTERM.
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
-	srv.stop = make(chan interface{}, 1)
 
 	// wait for signal
+	ctxShutDown := context.Background()
 	select {
-	case <-srv.stop:
+	case ctxShutDown = <-stop:
 	case <-done:
 	}
 
@@ -328,14 +399,18 @@ func (srv *Server) start(started ...chan interface{}) (err error) {
 
 	srv.logger.Info("Http server stopped")
 
-	ctxShutDown, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer func() {
-		cancel()
-	}()
+	if _, ok := ctxShutDown.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctxShutDown, cancel = context.WithTimeout(ctxShutDown, 20*time.Second)
+		defer func() {
+			cancel()
+		}()
+	}
 
 	if err = server.Shutdown(ctxShutDown); err != nil {
 		srv.logger.Error(fmt.Sprintf("server Shutdown Failed:%+s", err))
 	}
+	stopErr = err
 
 	srv.logger.Info("Http server exited properly")
 
@@ -347,10 +422,26 @@ func (srv *Server) start(started ...chan interface{}) (err error) {
 }
 
 func (srv *Server) Stop() {
-	if srv != nil && srv.stop != nil {
-		srv.stop <- "stop"
-		close(srv.stop)
+	_ = srv.Shutdown(context.Background())
+}
+
+// Shutdown waits for active requests until ctx is done, 20 seconds when ctx has no deadline.
+// It returns an error if they did not finish in time.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mux.Lock()
+	stop, stopped := srv.stop, srv.stopped
+	srv.mux.Unlock()
+
+	// the first Shutdown of a run is taken, the others wait for the same stop
+	select {
+	case stop <- ctx:
+	default:
 	}
+
+	<-stopped
+	srv.mux.Lock()
+	defer srv.mux.Unlock()
+	return srv.stopErr
 }
 
 // the socket proxy
@@ -373,6 +464,12 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// metrics are scraped past the request metrics and logging
+	if r.URL.Path == titan.MetricsPath {
+		metricsHandler.ServeHTTP(w, r)
+		return
+	}
+
 	//normal http request
 	srv.handler.ServeHTTP(w, r)
 }
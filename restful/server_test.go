@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"testing"
+	"time"
 
 	"gitlab.com/silenteer-oss/titan/restful"
 
@@ -142,3 +143,104 @@ func TestHttpsClient(t *testing.T) {
 	assert.NotEmpty(t, result.Status, "UP")
 
 }
+
+func TestMetricsEndPoint(t *testing.T) {
+	//1. setup server
+	port := test.FreePort(t)
+	server := restful.NewServer(restful.Port(port),
+		restful.Routes(func(r titan.Router) {
+			r.RegisterJson("GET", "/api/service/test/metrics/{id}", func(c *titan.Context) (*titan.Health, error) {
+				return &titan.Health{Status: titan.UP}, nil
+			})
+		}),
+	)
+
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/api/service/test/metrics/10002", port))
+	require.Nil(t, err)
+	_ = resp.Body.Close()
+
+	//2. requests are counted by route pattern
+	resp, err = http.Get(fmt.Sprintf("http://localhost:%s/metrics", port))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Contains(t, string(body), `titan_requests_total{method="GET",route="/api/service/test/metrics/{id}",status="200",subject="local"} 1`)
+}
+
+func TestShutdown(t *testing.T) {
+	//1. a server which never started stops at once
+	port := test.FreePort(t)
+	require.NoError(t, restful.NewServer(restful.Port(port)).Shutdown(context2.Background()))
+
+	//2. concurrent shutdowns wait for the same stop
+	server := restful.NewServer(restful.Port(port))
+	started := make(chan interface{}, 1)
+	go server.Start(started)
+	<-started
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- server.Shutdown(context2.Background()) }()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Shutdown did not return")
+		}
+	}
+}
+
+func TestStartError(t *testing.T) {
+	//1. the start error is returned and sent to the started channels instead of exiting
+	server := restful.NewServer(restful.Port(test.FreePort(t)), restful.TlsEnable(true), restful.TlsCert(cert), restful.TlsKey(""))
+	started := make(chan interface{}, 1)
+	err := server.Run(started)
+	require.Error(t, err)
+	assert.Equal(t, err, <-started)
+
+	//2. the server can be stopped right away
+	require.NoError(t, server.Shutdown(context2.Background()))
+}
+
+func TestHealthEndPoints(t *testing.T) {
+	//1. setup server with a failing critical checker
+	port := test.FreePort(t)
+	server := restful.NewServer(restful.Port(port))
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	titan.RegisterHealthChecker(titan.HealthChecker{Name: "db", Critical: true, Check: func(ctx context2.Context) error {
+		return fmt.Errorf("db unreachable")
+	}})
+	defer titan.UnregisterHealthChecker("db")
+
+	get := func(path string) (int, titan.Health) {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%s%s", port, path))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var health titan.Health
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+		return resp.StatusCode, health
+	}
+
+	//2. the service is alive
+	status, health := get("/health/live")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, titan.UP, health.Status)
+
+	//3. but not ready
+	status, health = get("/health/ready")
+	assert.Equal(t, 503, status)
+	assert.Equal(t, titan.DOWN, health.Status)
+	assert.Equal(t, "db unreachable", health.Checks["db"].Error)
+}
@@ -0,0 +1,128 @@
+package titan
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"logur.dev/logur"
+)
+
+// RetryPolicy describes how the client retries failed requests.
+// A request is retried when its method is in Methods and Retryable returns true for its status code,
+// transport errors are mapped to a status code first (timeout 408, no responders or open circuit 503, other 500).
+type RetryPolicy struct {
+	MaxAttempts    int           // total number of attempts, including the first one
+	InitialBackoff time.Duration // wait before the second attempt, doubled after every attempt
+	MaxBackoff     time.Duration // upper bound of the wait between two attempts
+	Methods        []string      // http methods which are safe to retry
+	Retryable      func(statusCode int) bool
+}
+
+// DefaultRetryPolicy retries idempotent requests on timeouts and unavailable services.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Methods:        []string{"GET", "HEAD", "PUT", "DELETE"},
+		Retryable: func(statusCode int) bool {
+			return statusCode == 408 || statusCode == 502 || statusCode == 503 || statusCode == 504
+		},
+	}
+}
+
+func (p *RetryPolicy) shouldRetry(method string, rp *Response, err error) bool {
+	if p.Retryable == nil {
+		return false
+	}
+
+	allowed := false
+	for _, m := range p.Methods {
+		if strings.EqualFold(m, method) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	if err != nil {
+		return p.Retryable(errorStatusCode(err))
+	}
+	return rp != nil && p.Retryable(rp.StatusCode)
+}
+
+// backoff returns an exponential wait with jitter between half and the full delay.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// WithRetryPolicy returns a client sharing the same connection which retries requests using the given policy.
+func (srv *Client) WithRetryPolicy(policy *RetryPolicy) *Client {
+	c := *srv
+	c.retryPolicy = policy
+	return &c
+}
+
+func (srv *Client) requestWithRetry(ctx context.Context, logger logur.Logger, rq *Request, subject string) (*Response, error) {
+	policy := srv.retryPolicy
+	for attempt := 1; ; attempt++ {
+		setRequestTimeout(ctx, rq)
+		rp, err := srv.requestWithCircuitBreaker(ctx, rq, subject)
+
+		if policy == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) || !policy.shouldRetry(rq.Method, rp, err) {
+			return rp, err
+		}
+
+		backoff := policy.backoff(attempt)
+		logInfo := map[string]interface{}{"url": rq.URL, "id": rq.Headers.Get(XRequestId), "attempt": attempt, "backoff_ms": backoff.Milliseconds()}
+		if err != nil {
+			logInfo["err"] = err.Error()
+		} else {
+			logInfo["status"] = rp.StatusCode
+		}
+		logger.Warn("Nats client retrying request", logInfo)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return rp, err
+		}
+	}
+}
+
+// setRequestTimeout propagates the remaining deadline so the server can give up together with the caller
+func setRequestTimeout(ctx context.Context, rq *Request) {
+	if deadline, ok := ctx.Deadline(); ok {
+		rq.Headers.Set(XRequestTimeout, strconv.FormatInt(int64(time.Until(deadline)/time.Millisecond), 10))
+	}
+}
+
+// errorStatusCode maps a transport error to the http status code reported to the caller
+func errorStatusCode(err error) int {
+	switch {
+	case errors.Is(err, nats.ErrTimeout), errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return 408
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, nats.ErrNoResponders):
+		return 503
+	default:
+		return 500
+	}
+}
@@ -1,12 +1,13 @@
 package titan
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"reflect"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10/non-standard/validators"
 	"github.com/opentracing/opentracing-go/ext"
@@ -37,6 +38,10 @@ type Router interface {
 	Register(method, pattern string, h HandlerFunc, a ...AuthFunc)
 	RegisterJson(method, pattern string, h Handler, a ...AuthFunc)
 	RegisterTopic(topic string, h Handler, a ...AuthFunc)
+	// WithTimeout returns a router whose routes time out after the given duration
+	// instead of Nats.ReadTimeout, e.g. r.WithTimeout(time.Minute).RegisterJson(...)
+	// Streamed responses are not buffered, their handler context gets the deadline instead.
+	WithTimeout(timeout time.Duration) Router
 }
 
 type Mux struct {
@@ -52,6 +57,12 @@ func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	m.Router.ServeHTTP(w, r)
 }
 
+func (m *Mux) WithTimeout(timeout time.Duration) Router {
+	return &Mux{Router: m.Router.With(func(next http.Handler) http.Handler {
+		return newTimeoutHandler(next, timeout, `{"message": "route handler timeout"}`)
+	})}
+}
+
 func (m *Mux) Register(method, path string, handlerFunc HandlerFunc, auths ...AuthFunc) {
 	path = AddSlashPrefixIfMissing(path)
 
@@ -94,12 +105,20 @@ func (m *Mux) RegisterTopic(topic string, h Handler, auths ...AuthFunc) {
 func (m *Mux) RegisterJson(method, path string, h Handler, auths ...AuthFunc) {
 	path = AddSlashPrefixIfMissing(path)
 
+	streamsBody := takesReader(h)
+
 	m.Router.MethodFunc(method, path, func(w http.ResponseWriter, r *http.Request) {
 		ctx := NewContext(r.Context())
 		ctx = ctx.WithValue(XPathParams, ParsePathParams(ctx))
 
 		var rp *Response
 
+		// handlers taking an io.Reader read the body themselves
+		if streamsBody {
+			ctx = ctx.WithValue(XRequestBody, r.Body)
+			r.Body = http.NoBody
+		}
+
 		// add request to context
 		newRequest, err := HttpRequestToNatsRequest(r)
 		if err != nil {
@@ -113,6 +132,11 @@ func (m *Mux) RegisterJson(method, path string, h Handler, auths ...AuthFunc) {
 				} else {
 					rp = createUnAuthorizeResponse(ctx.RequestId(), newRequest.URL)
 				}
+			} else if key := newRequest.Headers.Get(XIdempotencyKey); key != "" {
+				// keys are scoped by route, the same key may be used on other endpoints
+				rp = handleIdempotent(ctx, method+" "+r.URL.Path+" "+key, func() *Response {
+					return handleJsonRequest(ctx, newRequest, h)
+				})
 			} else {
 				rp = handleJsonRequest(ctx, newRequest, h)
 			}
@@ -138,6 +162,19 @@ func writeResponse(w http.ResponseWriter, rp *Response) error {
 		w.WriteHeader(rp.StatusCode)
 	}
 
+	// write streamed body
+	if rp.Stream != nil {
+		cw := &chunkWriter{w: w}
+		err := rp.Stream(cw)
+		if err == nil {
+			err = cw.Flush()
+		}
+		if err != nil {
+			return errors.WithMessage(err, "Writing stream response error")
+		}
+		return nil
+	}
+
 	// write body
 	if rp.Body != nil {
 		_, err := w.Write(rp.Body)
@@ -190,7 +227,7 @@ func handleJsonResponse(ctx *Context, r *Request, cb Handler) *Response {
 	}
 
 	//1. call function handler
-	ret, err := callJsonHandler(ctx, r.Body, cb)
+	ret, err := callJsonHandler(ctx, requestCodec(r.Headers), r.Body, cb)
 
 	if err != nil {
 		err = UnwrapErr(err)
@@ -311,21 +348,23 @@ func handleJsonResponse(ctx *Context, r *Request, cb Handler) *Response {
 		return ret.(*Response)
 	default:
 		_ = v
-		//2. process result
-		retJson, err := json.Marshal(ret)
+		//2. process result with the codec the caller accepts
+		codec := responseCodec(r.Headers)
+		retBody, err := codec.Marshal(ret)
 		if err != nil {
-			logger.Error(fmt.Sprintf("response json encoding error: %+v\n", err))
+			logger.Error(fmt.Sprintf("response encoding error: %+v\n", err))
 			return builder.
 				StatusCode(500).
 				BodyJSON(&DefaultJsonError{
-					Message: "response json encoding error:" + err.Error(),
+					Message: "response encoding error:" + err.Error(),
 					TraceId: ctx.RequestId(),
 					Links:   map[string][]string{"self": {r.URL}},
 				}).
 				Build()
 		}
 		return builder.
-			Body(retJson).
+			SetHeader(contentType, codec.ContentType()).
+			Body(retBody).
 			Build()
 	}
 }
@@ -335,49 +374,68 @@ var emptyReqType = reflect.TypeOf(&Request{})
 
 //var emptyResType = reflect.TypeOf(&Response{})
 var emptyContextType = reflect.TypeOf(&Context{})
+var readerType = reflect.TypeOf((*io.Reader)(nil)).Elem()
 var errorType = reflect.TypeOf((*error)(nil)).Elem()
 var handlerFormatError = errors.New("Handler needs to be a func \n `func(c *Context, interface{}) (interface{}, error)` or \n `func(c *Context) (interface{}, error)`")
 var handlerExample = "\n Example: `func(c *Context, interface{}) (interface{}, error)` or \n `func(c *Context) (interface{}, error)`"
 
-func callJsonHandler(ctx *Context, body []byte, cb interface{}) (interface{}, error) {
+// takesReader reports whether the handler reads the request body as an io.Reader, e.g. for uploads
+func takesReader(cb interface{}) bool {
+	cbType := reflect.TypeOf(cb)
+	return cbType != nil && cbType.Kind() == reflect.Func && cbType.NumIn() == 2 && cbType.In(1) == readerType
+}
+
+// checkJsonHandler returns an error when the handler cannot be called by callJsonHandler
+func checkJsonHandler(cb interface{}) error {
 	if cb == nil {
-		return nil, errors.New("nats: Handler is required")
+		return errors.New("nats: Handler is required")
 	}
 	cbType := reflect.TypeOf(cb)
 
 	if cbType.Kind() != reflect.Func {
-		return nil, handlerFormatError
+		return handlerFormatError
 	}
 
 	numIn := cbType.NumIn()
 	numOut := cbType.NumOut()
 
 	if numIn == 0 || numIn > 2 {
-		return nil, errors.New("Handler requires one or two parameters " + handlerExample)
+		return errors.New("Handler requires one or two parameters " + handlerExample)
 	}
 
 	if cbType.In(0) != emptyContextType {
-		return nil, errors.New("Handler requires first parameter must be instance of nats.Context " + handlerExample)
+		return errors.New("Handler requires first parameter must be instance of nats.Context " + handlerExample)
 	}
 
 	if numOut == 0 || numOut > 2 {
-		return nil, errors.New("Handler requires one or two return values " + handlerExample)
+		return errors.New("Handler requires one or two return values " + handlerExample)
 	}
 
 	if cbType.Out(numOut-1) != errorType {
-		return nil, errors.New("Handler requires second return value is an `error` " + handlerExample)
+		return errors.New("Handler requires second return value is an `error` " + handlerExample)
 	}
+	return nil
+}
 
-	argType := cbType.In(numIn - 1)
-
-	if argType == nil {
-		return nil, errors.New("nats: Handler requires at least one argument")
+func callJsonHandler(ctx *Context, codec Codec, body []byte, cb interface{}) (interface{}, error) {
+	if err := checkJsonHandler(cb); err != nil {
+		return nil, err
 	}
+	cbType := reflect.TypeOf(cb)
+	numIn := cbType.NumIn()
+	numOut := cbType.NumOut()
+	argType := cbType.In(numIn - 1)
 
 	cbValue := reflect.ValueOf(cb)
 	oV := []reflect.Value{reflect.ValueOf(ctx)}
 
-	if numIn == 2 {
+	if numIn == 2 && argType == readerType {
+		body, ok := ctx.Value(XRequestBody).(io.Reader)
+		if !ok {
+			body = http.NoBody
+		}
+		oV = append(oV, reflect.ValueOf(&body).Elem())
+	} else if numIn == 2 {
 		if len(body) == 0 {
 			return nil, errors.New("Body is empty")
 		}
@@ -392,7 +450,7 @@ func callJsonHandler(ctx *Context, body []byte, cb interface{}) (interface{}, er
 			} else {
 				oPtr = reflect.New(argType.Elem())
 			}
-			if err := decode(body, oPtr.Interface()); err != nil {
+			if err := decode(codec, body, oPtr.Interface()); err != nil {
 				return nil, err
 			}
 			if argType.Kind() != reflect.Ptr {
@@ -421,7 +479,7 @@ func callJsonHandler(ctx *Context, body []byte, cb interface{}) (interface{}, er
 }
 
 // Decode
-func decode(data []byte, vPtr interface{}) (err error) {
+func decode(codec Codec, data []byte, vPtr interface{}) (err error) {
 	switch arg := vPtr.(type) {
 	case *string:
 		// If they want a string and it is a JSON string, strip quotes
@@ -436,7 +494,7 @@ func decode(data []byte, vPtr interface{}) (err error) {
 	case *[]byte:
 		*arg = data
 	default:
-		err = json.Unmarshal(data, arg)
+		err = codec.Unmarshal(data, arg)
 		if err == nil {
 			err = validate.Struct(arg)
 		}
@@ -0,0 +1,64 @@
+package titan
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	BROADCAST = "broadcast"
+
+	defaultScatterGatherTimeout = 5 * time.Second
+)
+
+// BroadcastSubject is the subject every server instance subscribes to without a queue group,
+// requests sent to it reach all instances of the service.
+func BroadcastSubject(subject string) string {
+	return BROADCAST + "." + subject
+}
+
+type ScatterGatherOptions struct {
+	MaxReplies int           // stop collecting after this number of replies, 0 collects until the deadline
+	Timeout    time.Duration // how long to collect replies when ctx has no deadline, 5 seconds by default
+}
+
+// ScatterGather sends the request to every instance of the destination subject and collects
+// the replies until MaxReplies is reached or the deadline expires.
+// The hostname of each responder is found in the X-Hostname response header.
+func (srv *Client) ScatterGather(ctx *Context, rq *Request, opts *ScatterGatherOptions) ([]*Response, error) {
+	if opts == nil {
+		opts = &ScatterGatherOptions{}
+	}
+	logger := ctx.Logger()
+	requestId := setRequestHeaders(ctx, rq)
+
+	var reqCtx context.Context = ctx
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := opts.Timeout
+		if timeout <= 0 {
+			timeout = defaultScatterGatherTimeout
+		}
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	setRequestTimeout(reqCtx, rq)
+
+	subject := rq.Subject
+	if rq.Subject == "" {
+		subject = Url2Subject(rq.URL)
+	}
+
+	logger.Debug("Nats client scattering request to", map[string]interface{}{"url": rq.URL, "id": requestId, "method": rq.Method})
+	var responses []*Response
+	err := errNotSupported(srv.conn, "scatter-gather")
+	if s, ok := srv.conn.(ScatterGatherer); ok {
+		responses, err = s.ScatterGather(reqCtx, rq, BroadcastSubject(subject), opts.MaxReplies)
+	}
+	if err != nil {
+		return nil, &ClientResponseError{Message: err.Error(), Cause: err, Response: &Response{Status: "Internal Server Error: " + requestId, StatusCode: 500}}
+	}
+	logger.Debug("Nats client gathered replies", map[string]interface{}{"url": rq.URL, "id": requestId, "replies": len(responses)})
+
+	return responses, nil
+}
@@ -0,0 +1,26 @@
+package titan
+
+// semaphore bounds the number of messages handled at the same time, a nil semaphore does not limit.
+type semaphore chan struct{}
+
+func newSemaphore(size int) semaphore {
+	if size <= 0 {
+		return nil
+	}
+	return make(semaphore, size)
+}
+
+// acquire blocks the NATS subscription callback while all slots are taken, so further messages wait in the
+// pending queue of the subscription instead of piling up as goroutines. Core NATS keeps delivering to the
+// instance meanwhile, past the pending limits it drops messages as a slow consumer.
+func (s semaphore) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -1,12 +1,13 @@
 package titan
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 	"gitlab.com/silenteer-oss/titan/log"
 	"gitlab.com/silenteer-oss/titan/tracing"
 	"logur.dev/logur"
@@ -31,6 +33,10 @@ type Options struct {
 	router            Router
 	messageSubscriber *MessageSubscriber
 	tracer            opentracing.Tracer
+	maxConcurrency    int
+	drainTimeout      time.Duration
+	hooks             lifecycleHooks
+	metricsPort       string
 }
 
 func Logger(logger logur.Logger) Option {
@@ -68,6 +74,34 @@ func Subscribe(r func(*MessageSubscriber)) Option {
 	}
 }
 
+// MaxConcurrency limits the requests the server handles at the same time, Nats.MaxConcurrency (100) by default,
+// zero does not limit. While all are busy further requests wait in the pending queue of the subscription in
+// this instance, NATS does not hand them to other instances of the queue group. Past Nats.PendingLimitMsg or
+// Nats.PendingLimitByte they are dropped and their callers time out.
+func MaxConcurrency(max int) Option {
+	return func(o *Options) error {
+		o.maxConcurrency = max
+		return nil
+	}
+}
+
+// DrainTimeout is how long a stopping server waits for in-flight requests, Nats.DrainTimeout by default.
+func DrainTimeout(timeout time.Duration) Option {
+	return func(o *Options) error {
+		o.drainTimeout = timeout
+		return nil
+	}
+}
+
+// ServeMetrics serves the metrics at /metrics on the port, Metrics.Port by default.
+// Services with a restful.Server do not need it, it serves them too.
+func ServeMetrics(port string) Option {
+	return func(o *Options) error {
+		o.metricsPort = port
+		return nil
+	}
+}
+
 func NewServer(subject string, options ...Option) *Server {
 	tracing.InitTracing(subject)
 
@@ -96,6 +130,9 @@ func NewServer(subject string, options ...Option) *Server {
 		router:            NewRouter(r),
 		queue:             "workers",
 		messageSubscriber: NewMessageSubscriber(logger),
+		maxConcurrency:    natConfig.MaxConcurrency,
+		drainTimeout:      natConfig.GetDrainTimeoutDuration(),
+		metricsPort:       viper.GetString(MetricsPort),
 	}
 
 	// merge options with user define
@@ -108,7 +145,13 @@ func NewServer(subject string, options ...Option) *Server {
 		}
 	}
 
+	// not running, Shutdown returns at once
+	stopped := make(chan struct{})
+	close(stopped)
+
 	return &Server{
+		stop:              make(chan context.Context, 1),
+		stopped:           stopped,
 		subject:           subject,
 		queue:             opts.queue,
 		config:            opts.config,
@@ -116,20 +159,37 @@ func NewServer(subject string, options ...Option) *Server {
 		messageSubscriber: opts.messageSubscriber,
 		logger:            log.WithFields(opts.logger, map[string]interface{}{"queue": opts.queue}),
 		tracer:            opts.tracer,
+		sem:               newSemaphore(opts.maxConcurrency),
+		drainTimeout:      opts.drainTimeout,
+		hooks:             opts.hooks,
+		metricsPort:       opts.metricsPort,
 	}
 }
 
+// Start runs the server until it is stopped, see Run. The start error is logged.
 func (srv *Server) Start(started ...chan interface{}) {
-	err := srv.start(started...)
+	err := srv.Run(started...)
 	if err != nil {
 		srv.logger.Error(fmt.Sprintf("Nats server start error: %+v\n ", err))
-		os.Exit(1)
 	}
 }
 
+// Run runs the server until it is stopped. It returns the error which prevented the server
+// from starting, e.g. a failed OnStarting or OnStarted hook, the started channels receive it instead of true.
+func (srv *Server) Run(started ...chan interface{}) error {
+	err := srv.start(started...)
+	if err != nil {
+		for i := range started {
+			started[i] <- err
+		}
+	}
+	return err
+}
+
 // will change this to ServerInterface to make it consistency
 type IServer interface {
 	Stop()
+	Shutdown(ctx context.Context) error
 	Start(started ...chan interface{})
 }
 
@@ -140,13 +200,48 @@ type Server struct {
 	handler           http.Handler // handler to invoke, http.DefaultServeMux if nil
 	messageSubscriber *MessageSubscriber
 	logger            logur.Logger
-	stop              chan interface{} // command that instruct the server should be shutdown
-	stopped           chan interface{} // inform client that the server has stop
+	mux               sync.Mutex           // guards the run state below
+	stop              chan context.Context // command that instruct the server should be shutdown
+	stopped           chan struct{}        // closed when the server has stopped
+	stopErr           error                // the in-flight requests did not finish in time
 	//msgNum            int64            // number of processing messages
-	tracer opentracing.Tracer
+	tracer       opentracing.Tracer
+	sem          semaphore      // bounds the requests handled at the same time
+	inFlight     sync.WaitGroup // requests being handled
+	drainTimeout time.Duration
+	hooks        lifecycleHooks
+	metricsPort  string
+}
+
+// beginRun marks the server running, the returned channel receives the context of Shutdown
+func (srv *Server) beginRun() (chan context.Context, error) {
+	srv.mux.Lock()
+	defer srv.mux.Unlock()
+	select {
+	case <-srv.stopped:
+	default:
+		return nil, errors.New("nats: server is already running")
+	}
+	srv.stop = make(chan context.Context, 1)
+	srv.stopped = make(chan struct{})
+	srv.stopErr = nil
+	return srv.stop, nil
+}
+
+func (srv *Server) endRun(stopErr error) {
+	srv.mux.Lock()
+	defer srv.mux.Unlock()
+	srv.stopErr = stopErr
+	close(srv.stopped)
 }
 
 func (srv *Server) start(started ...chan interface{}) error {
+	stop, err := srv.beginRun()
+	if err != nil {
+		return err
+	}
+	var stopErr error
+	defer func() { srv.endRun(stopErr) }()
 
 	if srv.handler == nil {
 		return errors.New("nats: Handler not found")
@@ -173,29 +268,69 @@ func (srv *Server) start(started ...chan interface{}) error {
 		return errors.New("nats: ReadTimeout can not be empty")
 	}
 
-	timeoutHandler := http.TimeoutHandler(srv.handler, config.GetReadTimeoutDuration(), `{"message": "nats handler timeout"}`)
+	// dependencies must be ready before the first request arrives
+	err = runStartHooks(context.Background(), srv.hooks.starting, "starting")
+	if err != nil {
+		return err
+	}
+
+	// the stop hooks release what the starting hooks acquired when the server fails to start from here on
+	var conn *Connection
+	var subscription, broadcastSubscription, binarySubscription *nats.Subscription
+	abort := func(err error, message string) error {
+		stopErr = srv.abortStart(conn, subscription, broadcastSubscription, binarySubscription)
+		return errors.WithMessage(err, message)
+	}
+
+	if srv.metricsPort != "" {
+		metricsServer, err := serveMetrics(srv.logger, srv.metricsPort)
+		if err != nil {
+			return abort(err, "Nats metrics server error ")
+		}
+		defer func() { _ = metricsServer.Close() }()
+	}
+
+	timeoutHandler := newTimeoutHandler(srv.handler, config.GetReadTimeoutDuration(), `{"message": "nats handler timeout"}`)
 
 	srv.logger.Info("Connecting to NATS Server at: ", map[string]interface{}{"add": config.Servers})
-	conn, err := GetDefaultServer(config, srv.logger, srv.subject)
+	conn, err = GetDefaultServer(config, srv.logger, srv.subject)
 
 	if err != nil {
-		return errors.WithMessage(err, "Nats connection error ")
+		return abort(err, "Nats connection error ")
 	}
 
-	subscription, err := subscribe(conn.Conn, srv.logger, srv.subject, srv.queue, timeoutHandler)
+	subscription, err = subscribe(conn.Conn, srv.logger, srv.subject, srv.queue, timeoutHandler, srv.sem, &srv.inFlight)
 	if err != nil {
-		return errors.WithMessage(err, "Nats serve subscribe error ")
+		return abort(err, "Nats serve subscribe error ")
 	}
 	_monitoringSubscription = subscription
 
 	err = subscription.SetPendingLimits(config.PendingLimitMsg, config.PendingLimitByte)
 	if err != nil {
-		return errors.WithMessage(err, "Nats serve  set pending limits error ")
+		return abort(err, "Nats serve  set pending limits error ")
+	}
+
+	// every instance answers broadcast requests, see Client.ScatterGather
+	broadcastSubscription, err = subscribe(conn.Conn, srv.logger, BroadcastSubject(srv.subject), "", timeoutHandler, srv.sem, &srv.inFlight)
+	if err != nil {
+		return abort(err, "Nats serve broadcast subscribe error ")
+	}
+
+	// upgraded clients send binary envelope requests to their own subject, see BinarySubject
+	if conn.Conn.Conn.HeadersSupported() {
+		binarySubscription, err = subscribe(conn.Conn, srv.logger, BinarySubject(srv.subject), srv.queue, timeoutHandler, srv.sem, &srv.inFlight)
+		if err != nil {
+			return abort(err, "Nats serve binary subscribe error ")
+		}
+		err = binarySubscription.SetPendingLimits(config.PendingLimitMsg, config.PendingLimitByte)
+		if err != nil {
+			return abort(err, "Nats serve binary set pending limits error ")
+		}
 	}
 
 	err = srv.messageSubscriber.subscribe(conn.Conn)
 	if err != nil {
-		return errors.WithMessage(err, "Nats serve messageSubscriber error ")
+		return abort(err, "Nats serve messageSubscriber error ")
 	}
 
 	err = conn.Flush()
@@ -207,28 +342,42 @@ func (srv *Server) start(started ...chan interface{}) error {
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
 
-	// stop command from apps/users
-	srv.stop = make(chan interface{}, 1)
-
-	// notified unit test/other apps that the server has been stopped
-	srv.stopped = make(chan interface{}, 1)
+	ctx := context.Background()
+	startedErr := runStartHooks(ctx, srv.hooks.started, "started")
+	if startedErr == nil {
+		srv.logger.Info("Server started")
+		for i := range started {
+			started[i] <- true
+		}
 
-	srv.logger.Info("Server started")
-	for i := range started {
-		started[i] <- true
+		// wait for stop command  or interrupt (ctr+c)
+		select {
+		case ctx = <-stop:
+		case <-done:
+		}
 	}
-
-	// wait for stop command  or interrupt (ctr+c)
-	select {
-	case <-srv.stop:
-	case <-done:
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.drainTimeout)
+		defer cancel()
 	}
 
 	srv.logger.Info("Server is closing")
+	stopErr = runStopHooks(ctx, srv.logger, srv.hooks.stopping, "stopping")
 	er := subscription.Drain()
 	if er != nil {
 		srv.logger.Error(fmt.Sprintf("Unsubscribe error: %+v\n ", er))
 	}
+	er = broadcastSubscription.Drain()
+	if er != nil {
+		srv.logger.Error(fmt.Sprintf("Unsubscribe broadcast error: %+v\n ", er))
+	}
+	if binarySubscription != nil {
+		er = binarySubscription.Drain()
+		if er != nil {
+			srv.logger.Error(fmt.Sprintf("Unsubscribe binary error: %+v\n ", er))
+		}
+	}
 	srv.messageSubscriber.drain()
 
 	er = conn.Flush()
@@ -236,51 +385,112 @@ func (srv *Server) start(started ...chan interface{}) error {
 		srv.logger.Error(fmt.Sprintf("Flush error: %+v\n ", er))
 	}
 
-	close(srv.stop)
-	srv.stop = nil
+	// wait for all messages processed or timeout
+	subscriptions := append([]*nats.Subscription{subscription, broadcastSubscription, binarySubscription}, srv.messageSubscriber.subscriptions...)
+	er = srv.waitInFlight(ctx, subscriptions)
+	if er != nil {
+		srv.logger.Error(fmt.Sprintf("Nats server shutdown error: %+v\n ", er))
+		stopErr = er
+	}
+
+	conn.Drain()
+
+	if er = runStopHooks(ctx, srv.logger, srv.hooks.stopped, "stopped"); er != nil && stopErr == nil {
+		stopErr = er
+	}
+
+	srv.logger.Info("Server Stopped")
+	return startedErr
+}
+
+// abortStart stops a server failing to start after its starting hooks succeeded, the subscriptions made so far
+// are drained and the connection is closed between the stopping and the stopped hooks
+func (srv *Server) abortStart(conn *Connection, subscriptions ...*nats.Subscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), srv.drainTimeout)
+	defer cancel()
+
+	stopErr := runStopHooks(ctx, srv.logger, srv.hooks.stopping, "stopping")
+	// draining keeps the durable consumers, unsubscribing would delete them
+	for _, sub := range append(subscriptions, srv.messageSubscriber.subscriptions...) {
+		if sub == nil {
+			continue
+		}
+		if er := sub.Drain(); er != nil {
+			srv.logger.Error(fmt.Sprintf("Drain error: %+v\n ", er))
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	if er := runStopHooks(ctx, srv.logger, srv.hooks.stopped, "stopped"); er != nil && stopErr == nil {
+		stopErr = er
+	}
+	return stopErr
+}
 
-	//check end of waiting messages
-	endOfMsg := make(chan struct{})
+// waitInFlight waits until the draining subscriptions delivered their pending messages
+// and the requests being handled are finished.
+func (srv *Server) waitInFlight(ctx context.Context, subscriptions []*nats.Subscription) error {
+	idle := make(chan struct{})
 	go func() {
-		var numOfMsg uint64
-		ticker := time.NewTicker(100 * time.Millisecond)
-		for range ticker.C {
-			numOfMsg = MsgCountLoad()
-			if numOfMsg <= 0 {
-				close(endOfMsg)
-				return
+		for _, sub := range subscriptions {
+			for sub.IsValid() {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
 			}
 		}
+		srv.inFlight.Wait()
+		srv.messageSubscriber.inFlight.Wait()
+		close(idle)
 	}()
 
-	// wait for all messages processed or timeout
 	select {
-	case <-endOfMsg:
-	case <-time.After(15 * time.Second):
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return errors.WithMessage(ctx.Err(), "nats: in-flight requests not finished")
 	}
-
-	conn.Drain()
-
-	srv.stopped <- "stopped"
-	close(srv.stopped)
-	srv.logger.Info("Server Stopped")
-	return nil
 }
 
+// Stop waits up to the drain timeout for in-flight requests, see Shutdown.
 func (srv *Server) Stop() {
-	if srv != nil && srv.stop != nil {
-		srv.stop <- "stop command"
+	_ = srv.Shutdown(context.Background())
+}
+
+// Shutdown stops receiving requests and waits for the in-flight ones until ctx is done,
+// or the drain timeout passed when ctx has no deadline. It returns an error if they did not finish in time.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mux.Lock()
+	stop, stopped := srv.stop, srv.stopped
+	srv.mux.Unlock()
+
+	// the first Shutdown of a run is taken, the others wait for the same stop
+	select {
+	case stop <- ctx:
+	default:
 	}
+
 	// wait for server stop
-	<-srv.stopped
+	<-stopped
+	srv.mux.Lock()
+	defer srv.mux.Unlock()
+	return srv.stopErr
 }
 
-func subscribe(conn *nats.EncodedConn, logger logur.Logger, subject string, queue string, handler http.Handler) (*nats.Subscription, error) {
-	return conn.QueueSubscribe(subject, queue, func(addr string, rpSubject string, r []byte) {
-		go func(enc *nats.EncodedConn, msg []byte) {
+func subscribe(conn *nats.EncodedConn, logger logur.Logger, subject string, queue string, handler http.Handler, sem semaphore, inFlight *sync.WaitGroup) (*nats.Subscription, error) {
+	return conn.QueueSubscribe(subject, queue, func(m *nats.Msg) {
+		inFlight.Add(1)
+		sem.acquire()
+		go func(enc *nats.EncodedConn, msg *nats.Msg) {
+			defer inFlight.Done()
+			defer sem.release()
 			//t := time.Now()
-			var rq Request
-			err := json.Unmarshal(msg, &rq)
+			rpSubject := msg.Reply
+			binary := isBinaryEnvelope(msg)
+			rq, err := decodeRequest(enc, msg)
 			if err != nil {
 				logger.Error(fmt.Sprintf("Nats server desrialize body error: %+v", err))
 				return
@@ -300,37 +510,80 @@ func subscribe(conn *nats.EncodedConn, logger logur.Logger, subject string, queu
 				"subject": subject,
 			})
 
-			defer handlePanic(conn, logWithId, rpSubject)
+			defer handlePanic(conn, logWithId, rpSubject, binary)
 
 			rp := &Response{
 				Headers: http.Header{},
 			}
 
-			BeginRequest(logWithId, &rq)
-			defer EndRequest(logWithId, rp)
+			BeginRequest(logWithId, rq)
 
-			httpReq, err := NatsRequestToHttpRequest(&rq)
+			httpReq, err := NatsRequestToHttpRequest(rq)
 			if err != nil {
-				replyError(enc, logWithId, err, rpSubject)
+				replyError(enc, logWithId, err, rpSubject, binary)
+				return
+			}
+
+			// rebuild the caller deadline, the handler context is cancelled when the caller gives up
+			callerCtx := httpReq.Context()
+			if timeout, err := strconv.ParseInt(rq.Headers.Get(XRequestTimeout), 10, 64); err == nil {
+				ctx, cancel := context.WithTimeout(httpReq.Context(), time.Duration(timeout)*time.Millisecond)
+				defer cancel()
+				httpReq = httpReq.WithContext(ctx)
+				callerCtx = ctx
+			}
+
+			// the client streams the body in chunks once we answered with the upload inbox
+			if rq.Headers.Get(XUpload) != "" {
+				upload, err := newUploadReader(httpReq.Context(), enc, rpSubject)
+				if err != nil {
+					replyError(enc, logWithId, err, rpSubject, binary)
+					return
+				}
+				defer func() { _ = upload.Close() }()
+				httpReq.Body = upload
+				httpReq.ContentLength = -1
+			}
+
+			// stream the response in ordered chunks to the reply inbox
+			if rq.Headers.Get(XStream) != "" {
+				window, _ := strconv.Atoi(rq.Headers.Get(XStreamWindow))
+				sw, err := newStreamWriter(httpReq.Context(), enc, rpSubject, window)
+				if err != nil {
+					replyError(enc, logWithId, err, rpSubject, binary)
+					return
+				}
+				handler.ServeHTTP(sw, httpReq)
+				rp.StatusCode = sw.statusCode
+				if err := sw.Close(); err != nil {
+					logWithId.Error(fmt.Sprintf("Nats error on closing stream: %+v\n ", err))
+				}
 				return
 			}
 
 			// forward request to Controller
 			handler.ServeHTTP(rp, httpReq)
 
+			// nobody waits for the reply once the caller deadline passed
+			if callerCtx.Err() != nil {
+				logWithId.Warn("Nats caller deadline exceeded, reply dropped")
+				return
+			}
+
 			rp.Headers.Set(XResponeTime, strconv.FormatInt(time.Now().UnixNano(), 10))
+			rp.Headers.Set(XHostname, hostname)
 
-			// send response back
-			err = enc.Publish(rpSubject, rp)
+			// send response back in the envelope of the request
+			err = publishResponse(enc, rpSubject, rp, binary)
 			if err != nil {
-				replyError(enc, logWithId, err, rpSubject)
+				replyError(enc, logWithId, err, rpSubject, binary)
 				logWithId.Error(fmt.Sprintf("Nats error on publish result back: %+v\n ", err))
 			}
-		}(conn, r)
+		}(conn, m)
 	})
 }
 
-func handlePanic(enc *nats.EncodedConn, logger logur.Logger, rpSubject string) {
+func handlePanic(enc *nats.EncodedConn, logger logur.Logger, rpSubject string, binary bool) {
 	if r := recover(); r != nil {
 		var ok bool
 		var err error
@@ -338,19 +591,20 @@ func handlePanic(enc *nats.EncodedConn, logger logur.Logger, rpSubject string) {
 		if !ok {
 			err = fmt.Errorf("panic : %v", r)
 		}
-		replyError(enc, logger, err, rpSubject)
+		replyError(enc, logger, err, rpSubject, binary)
 		logger.Info("panic recovered")
 	}
 }
 
-func replyError(enc *nats.EncodedConn, logger logur.Logger, err error, rpSubject string) {
+// replyError answers with 500 in the envelope of the request
+func replyError(enc *nats.EncodedConn, logger logur.Logger, err error, rpSubject string, binary bool) {
 	logger.Error(fmt.Sprintf("Nats error: : %+v\n ", err))
 	resp := &Response{
 		StatusCode: 500, // internal server error as default
 		Status:     "",
 		Headers:    http.Header{},
 	}
-	er := enc.Publish(rpSubject, resp)
+	er := publishResponse(enc, rpSubject, resp, binary)
 	if er != nil {
 		logger.Error(fmt.Sprintf("Nats error on reply back: %+v\n ", er))
 	}
@@ -1,21 +1,46 @@
 package titan_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"gitlab.com/silenteer-oss/titan"
 
 	"gitlab.com/silenteer-oss/titan/test"
 
+	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
+func TestMain(m *testing.M) {
+	embeddedNats, err := test.NewEmbeddedNats()
+	if err != nil {
+		fmt.Printf("Embedded nats start error: %+v\n", err)
+		os.Exit(1)
+	}
+
+	exitVal := m.Run()
+
+	embeddedNats.Shutdown()
+	os.Exit(exitVal)
+}
+
 type GetResult struct {
 	RequestId   string            `json:"RequestId"`
 	QueryParams titan.QueryParams `json:"QueryParams"`
@@ -319,3 +344,1236 @@ func TestUnwrapError(t *testing.T) {
 		t.Error("return error is not ClientResponseError")
 	}
 }
+
+func TestDeadlinePropagation(t *testing.T) {
+	handlerCancelled := make(chan interface{})
+
+	//1. setup server
+	server := titan.NewServer("api.service.test",
+		titan.Routes(func(r titan.Router) {
+			r.RegisterJson("GET", "/api/service/test/slow", func(c *titan.Context) (*TestBody, error) {
+				<-c.Done()
+				close(handlerCancelled)
+				return nil, c.Err()
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	//2. client request it with a short deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	request, _ := titan.NewReqBuilder().Get("/api/service/test/slow").Build()
+
+	_, err := titan.GetDefaultClient().SendRequest(titan.NewContext(ctx), request)
+	require.Error(t, err, "Sending Nats request error")
+	require.IsType(t, &titan.ClientResponseError{}, err)
+	cerr, _ := err.(*titan.ClientResponseError)
+	assert.Equal(t, 408, cerr.Response.StatusCode)
+
+	//3. the handler context is cancelled as well
+	test.WaitOrTimeout(t, handlerCancelled, "Handler context not cancelled")
+}
+
+func TestRouteAndRequestTimeout(t *testing.T) {
+	line := []byte("0123456789abcdefghijklmnopqrstuvwxyz\n")
+	lines := 10000 // several chunks
+	proceed := make(chan struct{})
+
+	//1. setup server
+	server := titan.NewServer("api.service.test",
+		titan.Routes(func(r titan.Router) {
+			r.WithTimeout(100*time.Millisecond).RegisterJson("GET", "/api/service/test/report", func(c *titan.Context) (*TestBody, error) {
+				<-c.Done()
+				return nil, c.Err()
+			})
+			r.WithTimeout(5*time.Second).RegisterJson("GET", "/api/service/test/report/export", func(c *titan.Context) (*titan.Response, error) {
+				return titan.NewResBuilder().
+					Stream("text/plain", func(w io.Writer) error {
+						for i := 0; i < lines; i++ {
+							if _, err := w.Write(line); err != nil {
+								return err
+							}
+						}
+						<-proceed
+						return nil
+					}).
+					Build(), nil
+			})
+			r.RegisterJson("GET", "/api/service/test/lookup", func(c *titan.Context) (*TestBody, error) {
+				<-c.Done()
+				return nil, c.Err()
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	//2. route timeout
+	request, _ := titan.NewReqBuilder().Get("/api/service/test/report").Build()
+	_, err := titan.GetDefaultClient().SendRequest(titan.NewBackgroundContext(), request)
+	require.IsType(t, &titan.ClientResponseError{}, err)
+	assert.Equal(t, 503, err.(*titan.ClientResponseError).Response.StatusCode)
+
+	//3. request timeout
+	request, _ = titan.NewReqBuilder().Get("/api/service/test/lookup").Timeout(100 * time.Millisecond).Build()
+	_, err = titan.GetDefaultClient().SendRequest(titan.NewBackgroundContext(), request)
+	require.IsType(t, &titan.ClientResponseError{}, err)
+	assert.Equal(t, 408, err.(*titan.ClientResponseError).Response.StatusCode)
+
+	//4. responses of routes with a timeout are streamed, the first chunks arrive before the handler finished
+	request, _ = titan.NewReqBuilder().Get("/api/service/test/report/export").Build()
+	stream, err := titan.GetDefaultClient().SendStreamRequest(titan.NewBackgroundContext(), request)
+	close(proceed)
+	require.NoError(t, err)
+	defer stream.Body.Close()
+
+	body, err := ioutil.ReadAll(stream.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 200, stream.StatusCode)
+	assert.Equal(t, bytes.Repeat(line, lines), body)
+}
+
+func TestScatterGather(t *testing.T) {
+	//1. setup two instances of the same service
+	routes := titan.Routes(func(r titan.Router) {
+		r.RegisterJson("POST", "/api/service/test/invalidate", func(c *titan.Context) (*TestBody, error) {
+			return &TestBody{Msg: "ack"}, nil
+		})
+	})
+	servers := test.NewTestServers(titan.NewServer("api.service.test", routes), titan.NewServer("api.service.test", routes))
+	servers.Start()
+	defer servers.Stop()
+
+	//2. client scatters the request and gathers all acks
+	request, _ := titan.NewReqBuilder().Post("/api/service/test/invalidate").Build()
+	responses, err := titan.GetDefaultClient().ScatterGather(titan.NewBackgroundContext(), request, &titan.ScatterGatherOptions{MaxReplies: 2, Timeout: time.Second})
+	require.NoError(t, err)
+	require.Len(t, responses, 2)
+	for _, rp := range responses {
+		assert.Equal(t, 200, rp.StatusCode)
+		assert.NotEmpty(t, rp.Headers.Get(titan.XHostname))
+	}
+}
+
+func TestStreamResponse(t *testing.T) {
+	line := []byte("0123456789abcdefghijklmnopqrstuvwxyz\n")
+	lines := 10000 // several chunks
+
+	//1. setup server
+	server := titan.NewServer("api.service.test",
+		titan.Routes(func(r titan.Router) {
+			r.RegisterJson("GET", "/api/service/test/export", func(c *titan.Context) (*titan.Response, error) {
+				return titan.NewResBuilder().
+					Stream("text/plain", func(w io.Writer) error {
+						for i := 0; i < lines; i++ {
+							if _, err := w.Write(line); err != nil {
+								return err
+							}
+						}
+						return nil
+					}).
+					Build(), nil
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	//2. client reads the stream
+	request, _ := titan.NewReqBuilder().Get("/api/service/test/export").Build()
+	stream, err := titan.GetDefaultClient().SendStreamRequest(titan.NewBackgroundContext(), request)
+	require.NoError(t, err)
+	defer stream.Body.Close()
+
+	body, err := ioutil.ReadAll(stream.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 200, stream.StatusCode)
+	assert.Equal(t, "text/plain", stream.Headers.Get("Content-Type"))
+	assert.Equal(t, bytes.Repeat(line, lines), body)
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 64*1024)
+	written := make(chan int, 1)
+
+	//1. setup server writing until the client is gone
+	server := titan.NewServer("api.service.test",
+		titan.Routes(func(r titan.Router) {
+			r.RegisterJson("GET", "/api/service/test/endless", func(c *titan.Context) (*titan.Response, error) {
+				return titan.NewResBuilder().
+					Stream("application/octet-stream", func(w io.Writer) error {
+						for i := 0; ; i++ {
+							if _, err := w.Write(chunk); err != nil {
+								written <- i
+								return err
+							}
+						}
+					}).
+					Build(), nil
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	//2. the server waits for the client reading, and stops once the body is closed
+	request, _ := titan.NewReqBuilder().Get("/api/service/test/endless").Build()
+	stream, err := titan.GetDefaultClient().SendStreamRequest(titan.NewBackgroundContext(), request)
+	require.NoError(t, err)
+	_, err = io.ReadFull(stream.Body, make([]byte, 3*len(chunk)))
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, stream.Body.Close())
+
+	select {
+	case n := <-written:
+		assert.Less(t, n, 20)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream writer not stopped")
+	}
+}
+
+type UploadResult struct {
+	Size     int64 `json:"size"`
+	Uploaded bool  `json:"uploaded"`
+}
+
+func TestUploadRequest(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 30000) // several chunks
+
+	//1. setup server
+	server := titan.NewServer("api.service.test",
+		titan.Routes(func(r titan.Router) {
+			r.RegisterJson("POST", "/api/service/test/import", func(c *titan.Context, body io.Reader) (*UploadResult, error) {
+				size, err := io.Copy(ioutil.Discard, body)
+				return &UploadResult{Size: size, Uploaded: c.Request().Headers.Get(titan.XUpload) != ""}, err
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	//2. client streams the body
+	request, _ := titan.NewReqBuilder().Post("/api/service/test/import").Build()
+	rp, err := titan.GetDefaultClient().SendUploadRequest(titan.NewBackgroundContext(), request, bytes.NewReader(payload))
+	require.NoError(t, err)
+
+	var result UploadResult
+	require.NoError(t, json.Unmarshal(rp.Body, &result))
+	assert.Equal(t, 200, rp.StatusCode)
+	assert.Equal(t, int64(len(payload)), result.Size)
+
+	//3. a gateway streams large bodies, small ones are forwarded in the request
+	gateway := httptest.NewServer(titan.ForwardHandler(titan.GetDefaultClient()))
+	defer gateway.Close()
+	for _, size := range []int{len(payload), 100} {
+		httpRp, err := http.Post(gateway.URL+"/api/service/test/import", "application/octet-stream", bytes.NewReader(payload[:size]))
+		require.NoError(t, err)
+		require.NoError(t, json.NewDecoder(httpRp.Body).Decode(&result))
+		_ = httpRp.Body.Close()
+		assert.Equal(t, 200, httpRp.StatusCode)
+		assert.Equal(t, int64(size), result.Size)
+		assert.Equal(t, size > 100, result.Uploaded)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	//1. setup server
+	server := titan.NewServer("api.service.test",
+		titan.Routes(func(r titan.Router) {
+			r.RegisterJson("POST", "/api/service/test/codec/{id}", func(c *titan.Context, rq *PostRequest) (*PostResponse, error) {
+				return &PostResponse{
+					Id:       c.PathParams()["id"],
+					FullName: fmt.Sprintf("%s %s", rq.FirstName, rq.LastName),
+				}, nil
+			})
+			r.RegisterJson("POST", "/api/service/test/codec/proto/echo", func(c *titan.Context, rq *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+				return wrapperspb.String("echo " + rq.Value), nil
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	//2. msgpack body and result
+	request, _ := titan.NewReqBuilder().
+		Post("/api/service/test/codec/1111").
+		SetHeader("Accept", "application/x-msgpack").
+		BodyCodec(titan.MsgpackCodec, &PostRequest{FirstName: "John", LastName: "Doe"}).
+		Build()
+	var result PostResponse
+	err := titan.GetDefaultClient().SendAndReceiveJson(titan.NewBackgroundContext(), request, &result)
+	require.NoError(t, err)
+	assert.Equal(t, PostResponse{Id: "1111", FullName: "John Doe"}, result)
+
+	//3. protobuf body and result
+	request, _ = titan.NewReqBuilder().
+		Post("/api/service/test/codec/proto/echo").
+		BodyCodec(titan.ProtobufCodec, wrapperspb.String("hello")).
+		Build()
+	rp, err := titan.GetDefaultClient().SendRequest(titan.NewBackgroundContext(), request)
+	require.NoError(t, err)
+	assert.Equal(t, "application/x-protobuf", rp.Headers.Get("Content-Type"))
+	var echo wrapperspb.StringValue
+	require.NoError(t, titan.ProtobufCodec.Unmarshal(rp.Body, &echo))
+	assert.Equal(t, "echo hello", echo.Value)
+}
+
+func TestBinaryEnvelope(t *testing.T) {
+	config := titan.GetNatsConfig()
+	config.Envelope = titan.EnvelopeBinary
+	defer func() { config.Envelope = titan.EnvelopeJSON }()
+	client := titan.GetDefaultClient()
+
+	//1. setup an upgraded server and a legacy service which only understands JSON
+	messageReceived := make(chan *titan.Message, 1)
+	server := titan.NewServer("api.service.test",
+		titan.Routes(func(r titan.Router) {
+			r.RegisterJson("POST", "/api/service/test/envelope", func(c *titan.Context, rq *PostRequest) (*PostResponse, error) {
+				return &PostResponse{Id: c.RequestId(), FullName: rq.FirstName + " " + rq.LastName}, nil
+			})
+		}),
+		titan.Subscribe(func(ms *titan.MessageSubscriber) {
+			ms.Register("test.envelope", "", func(m *titan.Message) error {
+				messageReceived <- m
+				return nil
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	nc, err := nats.Connect(config.Servers)
+	require.NoError(t, err)
+	defer nc.Close()
+	legacy, err := nats.NewEncodedConn(nc, nats.JSON_ENCODER)
+	require.NoError(t, err)
+	_, err = legacy.Subscribe("api.legacy.test", func(subject, reply string, rq *titan.Request) {
+		_ = legacy.Publish(reply, &titan.Response{StatusCode: 200, Body: []byte(`{"FullName":"legacy"}`)})
+	})
+	require.NoError(t, err)
+	legacyMessages, err := nc.SubscribeSync("test.envelope")
+	require.NoError(t, err)
+	require.NoError(t, legacy.Flush())
+
+	//2. the upgraded server answers in the binary envelope
+	msg := nats.NewMsg(titan.BinarySubject("api.service.test"))
+	msg.Header.Set(titan.XEnvelope, titan.EnvelopeBinary)
+	msg.Header.Set(titan.XEnvelopeMethod, "POST")
+	msg.Header.Set(titan.XEnvelopeUrl, "/api/service/test/envelope")
+	msg.Data = []byte(`{"FirstName":"John","LastName":"Doe"}`)
+	reply, err := nc.RequestMsg(msg, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, titan.EnvelopeBinary, reply.Header.Get(titan.XEnvelope))
+	assert.Equal(t, "200", reply.Header.Get(titan.XEnvelopeStatus))
+	assert.Contains(t, string(reply.Data), `"FullName":"John Doe"`)
+
+	// errors as well
+	msg = nats.NewMsg(titan.BinarySubject("api.service.test"))
+	msg.Header.Set(titan.XEnvelope, titan.EnvelopeBinary)
+	msg.Header.Set(titan.XEnvelopeMethod, "NOT A METHOD")
+	msg.Header.Set(titan.XEnvelopeUrl, "/api/service/test/envelope")
+	reply, err = nc.RequestMsg(msg, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, titan.EnvelopeBinary, reply.Header.Get(titan.XEnvelope))
+	assert.Equal(t, "500", reply.Header.Get(titan.XEnvelopeStatus))
+
+	//3. the client negotiates the envelope per destination
+	var result PostResponse
+	request, _ := titan.NewReqBuilder().Post("/api/service/test/envelope").BodyJSON(&PostRequest{FirstName: "John", LastName: "Doe"}).Build()
+	require.NoError(t, client.SendAndReceiveJson(titan.NewBackgroundContext(), request, &result))
+	assert.Equal(t, "John Doe", result.FullName)
+
+	request, _ = titan.NewReqBuilder().Post("/api/legacy/test").BodyJSON(&PostRequest{}).Build()
+	require.NoError(t, client.SendAndReceiveJson(titan.NewBackgroundContext(), request, &result))
+	assert.Equal(t, "legacy", result.FullName)
+
+	//4. messages
+	require.NoError(t, client.Publish(titan.NewBackgroundContext(), "test.envelope", TestBody{Msg: "binary msg"}))
+	select {
+	case m := <-messageReceived:
+		var tb TestBody
+		_, err := m.Parse(&tb)
+		require.NoError(t, err)
+		assert.Equal(t, "binary msg", tb.Msg)
+		assert.Empty(t, m.Headers.Get(titan.XEnvelope))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+
+	//5. messages stay JSON for subscribers which only understand JSON
+	legacyMsg, err := legacyMessages.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, legacyMsg.Header.Get(titan.XEnvelope))
+	var legacyMessage titan.Message
+	require.NoError(t, json.Unmarshal(legacyMsg.Data, &legacyMessage))
+	assert.Contains(t, string(legacyMessage.Body), "binary msg")
+}
+
+func TestNativeHeaders(t *testing.T) {
+	//1. setup server
+	server := titan.NewServer("api.service.test",
+		titan.Routes(func(r titan.Router) {
+			r.RegisterJson("GET", "/api/service/test/native", func(c *titan.Context) (*GetResult, error) {
+				return &GetResult{RequestId: c.RequestId()}, nil
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	nc, err := nats.Connect(titan.GetNatsConfig().Servers)
+	require.NoError(t, err)
+	defer nc.Close()
+
+	//2. metadata set by a non-titan tool is read from the native headers
+	msg := nats.NewMsg("api.service.test")
+	msg.Header.Set(titan.XRequestId, "native-id")
+	msg.Data = []byte(`{"method":"GET","url":"/api/service/test/native"}`)
+	reply, err := nc.RequestMsg(msg, 5*time.Second)
+	require.NoError(t, err)
+	var rp titan.Response
+	require.NoError(t, json.Unmarshal(reply.Data, &rp))
+	var result GetResult
+	require.NoError(t, json.Unmarshal(rp.Body, &result))
+	assert.Equal(t, "native-id", result.RequestId)
+
+	//3. titan publishes its metadata as native headers
+	sub, err := nc.SubscribeSync("test.native")
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+	ctx := titan.NewContext(context.WithValue(context.Background(), titan.XRequestId, "published-id"))
+	require.NoError(t, titan.GetDefaultClient().Publish(ctx, "test.native", TestBody{Msg: "test msg"}))
+	published, err := sub.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "published-id", published.Header.Get(titan.XRequestId))
+}
+
+func TestDurableSubscription(t *testing.T) {
+	ctx := titan.NewBackgroundContext()
+	client := titan.GetDefaultClient()
+
+	nc, err := nats.Connect(titan.GetNatsConfig().Servers)
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "EVENTS", Subjects: []string{"events.>"}, Storage: nats.MemoryStorage})
+	require.NoError(t, err)
+	defer func() { _ = js.DeleteStream("EVENTS") }()
+
+	//1. published while the service is down
+	seq, err := client.PublishPersistent(ctx, "events.created", TestBody{Msg: "first"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+
+	//2. the handler fails once, the message is delivered again
+	received := make(chan string, 10)
+	failed := false
+	server := titan.NewServer("api.service.test",
+		titan.Subscribe(func(ms *titan.MessageSubscriber) {
+			ms.RegisterDurable("EVENTS", "test-consumer", func(m *titan.Message) error {
+				var tb TestBody
+				if _, err := m.Parse(&tb); err != nil {
+					return err
+				}
+				if tb.Msg == "second" && !failed {
+					failed = true
+					return errors.New("handler failure")
+				}
+				received <- tb.Msg
+				return nil
+			}, &titan.DurableOptions{MaxDeliver: 3, AckWait: time.Second})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	seq, err = client.PublishPersistent(ctx, "events.updated", TestBody{Msg: "second"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), seq)
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case msg := <-received:
+			assert.Equal(t, expected, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message %s not received", expected)
+		}
+	}
+	assert.True(t, failed)
+}
+
+func TestDeadLetter(t *testing.T) {
+	client := titan.GetDefaultClient()
+
+	//1. setup server, the handler fails the first time
+	received := make(chan string, 10)
+	failed := false
+	server := titan.NewServer("api.service.test",
+		titan.Subscribe(func(ms *titan.MessageSubscriber) {
+			ms.Register("test.dl", "", func(m *titan.Message) error {
+				var tb TestBody
+				if _, err := m.Parse(&tb); err != nil {
+					return err
+				}
+				if !failed {
+					failed = true
+					return errors.New("handler failure")
+				}
+				received <- tb.Msg
+				return nil
+			}, titan.DeadLetterSubject("test.dl.dead"))
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	nc, err := nats.Connect(titan.GetNatsConfig().Servers)
+	require.NoError(t, err)
+	defer nc.Close()
+	deadLetters, err := nc.SubscribeSync("test.dl.dead")
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	replay, err := client.ReplayDeadLetters("test.dl.dead")
+	require.NoError(t, err)
+	defer func() { _ = replay.Unsubscribe() }()
+
+	//2. the failed message is dead-lettered with the failure details
+	ctx := titan.NewContext(context.WithValue(context.Background(), titan.XRequestId, "dead-id"))
+	require.NoError(t, client.Publish(ctx, "test.dl", TestBody{Msg: "test msg"}))
+
+	dead, err := deadLetters.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	var m titan.Message
+	require.NoError(t, json.Unmarshal(dead.Data, &m))
+	assert.Equal(t, "handler failure", m.Headers.Get(titan.XDeadLetterError))
+	assert.Equal(t, "1", m.Headers.Get(titan.XDeadLetterAttempts))
+	assert.Equal(t, "test.dl", m.Headers.Get(titan.XDeadLetterSubject))
+	assert.Equal(t, "dead-id", m.Headers.Get(titan.XRequestId))
+
+	//3. and replayed to the original subject
+	select {
+	case msg := <-received:
+		assert.Equal(t, "test msg", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dead letter not replayed")
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	var mux sync.Mutex
+	active, peak := 0, 0
+	busy := func() func() {
+		mux.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mux.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		return func() {
+			mux.Lock()
+			active--
+			mux.Unlock()
+		}
+	}
+
+	//1. setup server handling two requests and two messages at the same time
+	handled := make(chan struct{}, 6)
+	server := titan.NewServer("api.service.test",
+		titan.MaxConcurrency(2),
+		titan.Routes(func(r titan.Router) {
+			r.RegisterJson("GET", "/api/service/test/busy", func(c *titan.Context) (*TestBody, error) {
+				defer busy()()
+				return &TestBody{Msg: "done"}, nil
+			})
+		}),
+		titan.Subscribe(func(ms *titan.MessageSubscriber) {
+			ms.Register("test.busy", "", func(m *titan.Message) error {
+				defer busy()()
+				handled <- struct{}{}
+				return nil
+			}, titan.HandlerConcurrency(2))
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	//2. a burst of requests is handled two at a time
+	client := titan.GetDefaultClient()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request, _ := titan.NewReqBuilder().Get("/api/service/test/busy").Build()
+			rp, err := client.SendRequest(titan.NewBackgroundContext(), request)
+			if assert.NoError(t, err) {
+				assert.Equal(t, 200, rp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+	mux.Lock()
+	assert.Equal(t, 2, peak)
+	peak = 0
+	mux.Unlock()
+
+	//3. and so is a burst of messages
+	for i := 0; i < 6; i++ {
+		require.NoError(t, client.Publish(titan.NewBackgroundContext(), "test.busy", TestBody{Msg: "busy"}))
+	}
+	for i := 0; i < 6; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not handled")
+		}
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Equal(t, 2, peak)
+
+	//4. concurrency and pending requests are bounded by default
+	config := titan.GetNatsConfig()
+	assert.True(t, config.MaxConcurrency > 0)
+	assert.True(t, config.PendingLimitMsg > 0)
+	assert.True(t, config.PendingLimitByte > 0)
+}
+
+func TestShutdown(t *testing.T) {
+	newServer := func(handling chan struct{}, duration time.Duration, options ...titan.Option) *titan.Server {
+		return titan.NewServer("api.service.test", append(options, titan.Routes(func(r titan.Router) {
+			r.RegisterJson("GET", "/api/service/test/slow", func(c *titan.Context) (*TestBody, error) {
+				handling <- struct{}{}
+				time.Sleep(duration)
+				return &TestBody{Msg: "done"}, nil
+			})
+		}))...)
+	}
+	client := titan.GetDefaultClient()
+	send := func(timeout time.Duration) chan error {
+		result := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			request, _ := titan.NewReqBuilder().Get("/api/service/test/slow").Build()
+			_, err := client.SendRequest(titan.NewContext(ctx), request)
+			result <- err
+		}()
+		return result
+	}
+
+	//1. shutdown waits for the in-flight request
+	handling := make(chan struct{}, 1)
+	server := newServer(handling, 300*time.Millisecond)
+	test.NewTestServer(t, server).Start()
+	result := send(5 * time.Second)
+	<-handling
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+	require.NoError(t, <-result)
+
+	//2. and gives up after the drain timeout
+	server = newServer(handling, 2*time.Second, titan.DrainTimeout(100*time.Millisecond))
+	test.NewTestServer(t, server).Start()
+	result = send(time.Second)
+	<-handling
+
+	assert.Error(t, server.Shutdown(context.Background()))
+	<-result
+
+	//3. a server which never started stops at once
+	require.NoError(t, newServer(handling, 0).Shutdown(context.Background()))
+
+	//4. concurrent message handlers are drained too
+	var handled int32
+	server = titan.NewServer("api.service.test", titan.Subscribe(func(ms *titan.MessageSubscriber) {
+		ms.Register("test.shutdown", "", func(m *titan.Message) error {
+			handling <- struct{}{}
+			time.Sleep(300 * time.Millisecond)
+			atomic.AddInt32(&handled, 1)
+			return nil
+		}, titan.HandlerConcurrency(2))
+	}))
+	test.NewTestServer(t, server).Start()
+	require.NoError(t, client.Publish(titan.NewBackgroundContext(), "test.shutdown", TestBody{Msg: "drain"}))
+	<-handling
+	require.NoError(t, server.Shutdown(ctx))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handled))
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	var mux sync.Mutex
+	var events []string
+	hook := func(event string, err error) titan.Hook {
+		return func(ctx context.Context) error {
+			mux.Lock()
+			defer mux.Unlock()
+			events = append(events, event)
+			return err
+		}
+	}
+	happened := func() []string {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]string(nil), events...)
+	}
+
+	//1. setup server, closing its resources fails
+	server := titan.NewServer("api.service.test",
+		titan.OnStarting(hook("starting", nil)),
+		titan.OnStarted(hook("started", nil)),
+		titan.OnStopping(hook("stopping", nil)),
+		titan.OnStopped(hook("stopped", errors.New("pool close error"))),
+		titan.Routes(func(r titan.Router) {
+			r.RegisterJson("GET", "/api/service/test/hooks", func(c *titan.Context) (*TestBody, error) {
+				return &TestBody{Msg: strings.Join(happened(), ",")}, nil
+			})
+		}),
+	)
+	test.NewTestServer(t, server).Start()
+
+	//2. requests arrive once the server started
+	request, _ := titan.NewReqBuilder().Get("/api/service/test/hooks").Build()
+	rp, err := titan.GetDefaultClient().SendRequest(titan.NewBackgroundContext(), request)
+	require.NoError(t, err)
+	var tb TestBody
+	require.NoError(t, json.Unmarshal(rp.Body, &tb))
+	assert.Equal(t, "starting,started", tb.Msg)
+
+	//3. stop hooks run in order and their error is returned
+	err = server.Shutdown(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pool close error")
+	assert.Equal(t, []string{"starting", "started", "stopping", "stopped"}, happened())
+}
+
+func TestLifecycleHookFailures(t *testing.T) {
+	client := titan.GetDefaultClient()
+	ping := func() error {
+		request, _ := titan.NewReqBuilder().Get("/api/service/gating/ping").Timeout(200 * time.Millisecond).Build()
+		_, err := client.SendRequest(titan.NewBackgroundContext(), request)
+		return err
+	}
+	newServer := func(options ...titan.Option) *titan.Server {
+		return titan.NewServer("api.service.gating", append(options, titan.Routes(func(r titan.Router) {
+			r.RegisterJson("GET", "/api/service/gating/ping", func(c *titan.Context) (*TestBody, error) {
+				return &TestBody{Msg: "pong"}, nil
+			})
+		}))...)
+	}
+
+	//1. no request arrives while the starting hooks run, their error is returned instead of exiting
+	var pingErr error
+	server := newServer(titan.OnStarting(func(ctx context.Context) error {
+		pingErr = ping()
+		return errors.New("database is down")
+	}))
+	started := make(chan interface{}, 1)
+	err := server.Run(started)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "database is down")
+	assert.Error(t, pingErr)
+	assert.Equal(t, err, <-started)
+
+	//2. a failed started hook stops the server again and is sent to the started channels
+	stopped := false
+	server = newServer(
+		titan.OnStarted(func(ctx context.Context) error {
+			pingErr = ping()
+			return errors.New("warm up error")
+		}),
+		titan.OnStopped(func(ctx context.Context) error {
+			stopped = true
+			return nil
+		}),
+	)
+	result := make(chan error, 1)
+	go func() {
+		result <- server.Run(started)
+	}()
+	startedErr, ok := (<-started).(error)
+	require.True(t, ok)
+	assert.Contains(t, startedErr.Error(), "warm up error")
+	assert.NoError(t, pingErr)
+	assert.Equal(t, startedErr, <-result)
+	assert.True(t, stopped)
+	assert.Error(t, ping())
+
+	//3. failing to start after the starting hooks runs the stop hooks
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer listener.Close()
+	var events []string
+	hook := func(event string) titan.Hook {
+		return func(ctx context.Context) error {
+			events = append(events, event)
+			return nil
+		}
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	server = newServer(titan.ServeMetrics(port),
+		titan.OnStarting(hook("starting")),
+		titan.OnStopping(hook("stopping")),
+		titan.OnStopped(hook("stopped")),
+	)
+	err = server.Run()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "metrics")
+	assert.Equal(t, []string{"starting", "stopping", "stopped"}, events)
+
+	//4. and closes the subscriptions made before the failure
+	events = nil
+	server = newServer(
+		titan.OnStopped(hook("stopped")),
+		titan.Subscribe(func(ms *titan.MessageSubscriber) {
+			ms.RegisterDurable("MISSING", "test-consumer", func(m *titan.Message) error {
+				return nil
+			}, &titan.DurableOptions{})
+		}),
+	)
+	err = server.Run()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "messageSubscriber")
+	assert.Equal(t, []string{"stopped"}, events)
+	assert.Error(t, ping())
+}
+
+func TestHealthChecks(t *testing.T) {
+	client := titan.GetDefaultClient()
+	server := titan.NewServer("api.service.test")
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	titan.RegisterHealthChecker(titan.HealthChecker{Name: "cache", Check: func(ctx context.Context) error {
+		return errors.New("cache unreachable")
+	}})
+	defer titan.UnregisterHealthChecker("cache")
+
+	//1. a failing non critical checker is reported only
+	request, _ := titan.NewReqBuilder().Get("/api/service/test/health/ready").Build()
+	var health titan.Health
+	require.NoError(t, client.SendAndReceiveJson(titan.NewBackgroundContext(), request, &health))
+	assert.Equal(t, titan.UP, health.Status)
+	assert.Equal(t, titan.DOWN, health.Checks["cache"].Status)
+	assert.Equal(t, "cache unreachable", health.Checks["cache"].Error)
+
+	//2. a critical checker timing out makes the service not ready
+	titan.RegisterHealthChecker(titan.HealthChecker{Name: "db", Critical: true, Timeout: 50 * time.Millisecond, Check: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+	defer titan.UnregisterHealthChecker("db")
+
+	_, err := client.SendRequest(titan.NewBackgroundContext(), request)
+	require.IsType(t, &titan.ClientResponseError{}, err)
+	rp := err.(*titan.ClientResponseError).Response
+	assert.Equal(t, 503, rp.StatusCode)
+	require.NoError(t, json.Unmarshal(rp.Body, &health))
+	assert.Equal(t, titan.DOWN, health.Status)
+	assert.True(t, health.Checks["db"].Critical)
+
+	//3. the broadcast health check reports the checks too
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	replies := make(chan titan.Health, 1)
+	sub, err := client.Subscribe(titan.HEALTH_CHECK_REPLY, func(m *titan.Message) {
+		var h titan.Health
+		if json.Unmarshal(m.Body, &h) == nil && h.Subject == "api.service.test" {
+			replies <- h
+		}
+	})
+	require.NoError(t, err)
+	defer func() { _ = sub.Unsubscribe() }()
+	require.NoError(t, client.Publish(titan.NewBackgroundContext(), titan.HEALTH_CHECK+"_"+strings.ReplaceAll(hostname, " ", "_"), TestBody{}))
+	select {
+	case h := <-replies:
+		assert.Equal(t, titan.DOWN, h.Status)
+		assert.Equal(t, titan.DOWN, h.Checks["db"].Status)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Health check reply not received")
+	}
+
+	//4. while it is still alive
+	for _, path := range []string{"/api/service/test/health/live", "/api/service/test/health"} {
+		request, _ = titan.NewReqBuilder().Get(path).Build()
+		health = titan.Health{}
+		require.NoError(t, client.SendAndReceiveJson(titan.NewBackgroundContext(), request, &health))
+		assert.Equal(t, titan.UP, health.Status)
+		assert.Empty(t, health.Checks)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	port := test.FreePort(t)
+	server := titan.NewServer("api.service.test", titan.ServeMetrics(port))
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	request, _ := titan.NewReqBuilder().Get("/api/service/test/health/live").Build()
+	_, err := titan.GetDefaultClient().SendRequest(titan.NewBackgroundContext(), request)
+	require.NoError(t, err)
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/metrics", port))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), `titan_requests_total{method="GET",route="/api/service/test/health/live",status="200",subject="api.service.test"}`)
+	assert.Contains(t, string(body), `titan_client_request_duration_seconds_count{method="GET",status="200",subject="api.service.test"}`)
+	assert.Contains(t, string(body), `titan_requests_in_flight{subject="api.service.test"}`)
+}
+
+func TestDeprecatedCounters(t *testing.T) {
+	before := titan.DoMonitoringCheck("api.service.test", nil)
+
+	// counts of callers still using the old counters show up in the monitoring
+	titan.MsgInNumAdd(2)
+	titan.MsgOutNumAdd(2)
+	titan.MsgErrNumAdd(1)
+	after := titan.DoMonitoringCheck("api.service.test", nil)
+	assert.Equal(t, before.MsgInNum+2, after.MsgInNum)
+	assert.Equal(t, before.MsgOutNum+2, after.MsgOutNum)
+	assert.Equal(t, before.MsgErrNum+1, after.MsgErrNum)
+}
+
+func TestProcessStatistics(t *testing.T) {
+	monitoring := titan.DoMonitoringCheck("api.service.test", nil)
+	assert.Equal(t, os.Getpid(), monitoring.Pid)
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc on this system")
+	}
+	assert.True(t, monitoring.Rss > 0)
+	assert.True(t, monitoring.OpenFds > 0)
+	assert.True(t, monitoring.Threads > 0)
+	assert.True(t, monitoring.Cpu >= 0)
+
+	// a stopped sampler starts again with the next reader
+	titan.StopProcessSampler()
+	monitoring = titan.DoMonitoringCheck("api.service.test", nil)
+	assert.True(t, monitoring.Rss > 0)
+
+	// the metrics report the statistics of the sampler
+	recorder := httptest.NewRecorder()
+	titan.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", titan.MetricsPath, nil))
+	for _, name := range []string{"titan_process_cpu_usage_percent", "titan_process_threads", "titan_process_resident_memory_bytes", "titan_process_open_fds"} {
+		assert.Contains(t, recorder.Body.String(), "\n"+name+" ")
+	}
+}
+
+func TestMessageSubscriberJson(t *testing.T) {
+	client := titan.GetDefaultClient()
+
+	//1. setup server with a typed, validated handler
+	received := make(chan string, 1)
+	server := titan.NewServer("api.service.test",
+		titan.Subscribe(func(ms *titan.MessageSubscriber) {
+			ms.RegisterJson("test.json", "", func(c *titan.Context, rq *TestValidationRequest) error {
+				received <- c.RequestId() + ":" + rq.FirstName + " " + rq.LastName
+				return nil
+			}, titan.DeadLetterSubject("test.json.dead"))
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	nc, err := nats.Connect(titan.GetNatsConfig().Servers)
+	require.NoError(t, err)
+	defer nc.Close()
+	deadLetters, err := nc.SubscribeSync("test.json.dead")
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	//2. a valid message reaches the handler with its context
+	ctx := titan.NewContext(context.WithValue(context.Background(), titan.XRequestId, "json-id"))
+	require.NoError(t, client.Publish(ctx, "test.json", TestValidationRequest{FirstName: "John", LastName: "Doe"}))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "json-id:John Doe", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+
+	//3. an invalid one fails validation
+	require.NoError(t, client.Publish(ctx, "test.json", TestValidationRequest{FirstName: "John"}))
+	dead, err := deadLetters.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	var m titan.Message
+	require.NoError(t, json.Unmarshal(dead.Data, &m))
+	assert.Contains(t, m.Headers.Get(titan.XDeadLetterError), "LastName")
+	assert.Empty(t, received)
+}
+
+func TestMessageSubscriberJsonSignature(t *testing.T) {
+	ms := titan.NewMessageSubscriber(titan.GetLogger())
+
+	//1. handlers of another signature are rejected when they are registered
+	assert.Panics(t, func() { ms.RegisterJson("test.json", "", "not a func") })
+	assert.Panics(t, func() { ms.RegisterJson("test.json", "", func(body *TestBody) error { return nil }) })
+	assert.Panics(t, func() { ms.RegisterJson("test.json", "", func(c *titan.Context, body *TestBody) {}) })
+	assert.Panics(t, func() {
+		ms.RegisterJson("test.json", "", func(c *titan.Context, body *TestBody) *TestBody { return nil })
+	})
+
+	//2. typed handlers are accepted
+	assert.NotPanics(t, func() { ms.RegisterJson("test.json", "", func(c *titan.Context, body *TestBody) error { return nil }) })
+	assert.NotPanics(t, func() {
+		ms.RegisterJson("test.json", "", func(c *titan.Context, body *TestBody) (*TestBody, error) { return body, nil })
+	})
+}
+
+func TestRequestMessage(t *testing.T) {
+	client := titan.GetDefaultClient()
+	ctx := titan.NewBackgroundContext()
+
+	//1. setup server answering messages
+	server := titan.NewServer("api.service.test",
+		titan.Subscribe(func(ms *titan.MessageSubscriber) {
+			ms.RegisterJson("test.rpc.fullname", "api.service.test", func(c *titan.Context, rq *TestValidationRequest) (*TestValidationResponse, error) {
+				return &TestValidationResponse{FullName: rq.FirstName + " " + rq.LastName}, nil
+			})
+			ms.RegisterReply("test.rpc.fail", "api.service.test", func(m *titan.Message) (interface{}, error) {
+				return nil, errors.New("cannot answer")
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	//2. the handler result is the reply
+	var rp TestValidationResponse
+	require.NoError(t, client.RequestMessage(ctx, "test.rpc.fullname", TestValidationRequest{FirstName: "John", LastName: "Doe"}, &rp))
+	assert.Equal(t, "John Doe", rp.FullName)
+
+	//3. so are validation and handler errors
+	err := client.RequestMessage(ctx, "test.rpc.fullname", TestValidationRequest{FirstName: "John"}, &rp)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "LastName")
+
+	err = client.RequestMessage(ctx, "test.rpc.fail", TestBody{Msg: "test"}, nil)
+	require.Error(t, err)
+	assert.Equal(t, "cannot answer", err.Error())
+}
+
+func TestSubjectTemplate(t *testing.T) {
+	//1. setup server subscribing a subject template
+	received := make(chan []string, 1)
+	server := titan.NewServer("api.service.test",
+		titan.Subscribe(func(ms *titan.MessageSubscriber) {
+			ms.Register("test.careprovider.{cpId}.patient.>", "", func(m *titan.Message) error {
+				var tb TestBody
+				c, err := m.Parse(&tb)
+				if err != nil {
+					return err
+				}
+				received <- []string{m.Subject, c.GetSubjectParam("cpId"), tb.Msg}
+				return nil
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	//2. the handler sees the concrete subject and its named tokens
+	require.NoError(t, titan.GetDefaultClient().Publish(titan.NewBackgroundContext(), "test.careprovider.cp-1.patient.p-2.created", TestBody{Msg: "created"}))
+	select {
+	case r := <-received:
+		assert.Equal(t, []string{"test.careprovider.cp-1.patient.p-2.created", "cp-1", "created"}, r)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+
+	//3. so does a handler of the memory connection
+	conn := titan.NewMemoryConnection()
+	subjects := make(chan string, 1)
+	_, err := conn.Subscribe("test.careprovider.*.patient.>", func(m *titan.Message) {
+		subjects <- m.Subject
+	})
+	require.NoError(t, err)
+	require.NoError(t, titan.NewClient(conn).Publish(titan.NewBackgroundContext(), "test.careprovider.cp-1.patient.p-2.created", TestBody{Msg: "created"}))
+	assert.Equal(t, "test.careprovider.cp-1.patient.p-2.created", <-subjects)
+
+	//4. invalid templates are rejected when they are registered
+	ms := titan.NewMessageSubscriber(titan.GetLogger())
+	handler := func(m *titan.Message) error { return nil }
+	assert.Panics(t, func() { ms.Register("test.careprovider.{}.patient", "", handler) })
+	assert.Panics(t, func() { ms.Register("test.{id}.patient.{id}", "", handler) })
+	assert.Panics(t, func() {
+		ms.RegisterDurable("EVENTS", "test", handler, &titan.DurableOptions{Subject: "test.{id}.{id}"})
+	})
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	client := titan.GetDefaultClient()
+	var mux sync.Mutex
+	calls := map[string]int{}
+	count := func(name string) int {
+		mux.Lock()
+		defer mux.Unlock()
+		calls[name]++
+		return calls[name]
+	}
+	counted := func(name string) int {
+		mux.Lock()
+		defer mux.Unlock()
+		return calls[name]
+	}
+
+	//1. setup server counting handler calls
+	messageHandled := make(chan struct{}, 2)
+	slowStarted := make(chan struct{}, 1)
+	slowRelease := make(chan struct{})
+	server := titan.NewServer("api.service.test",
+		titan.Routes(func(r titan.Router) {
+			r.RegisterJson("POST", "/api/service/test/orders", func(c *titan.Context, rq *TestBody) (*TestBody, error) {
+				return &TestBody{Msg: fmt.Sprintf("order %d", count("orders"))}, nil
+			})
+			// places two distinct orders, the first attempt fails after placing them
+			r.RegisterJson("POST", "/api/service/test/checkout", func(c *titan.Context, rq *TestBody) (*TestBody, error) {
+				for i := 0; i < 2; i++ {
+					request, _ := titan.NewReqBuilder().Post("/api/service/test/orders").BodyJSON(rq).Build()
+					if _, err := client.SendRequest(c, request); err != nil {
+						return nil, err
+					}
+				}
+				if count("checkout") == 1 {
+					return nil, errors.New("payment error")
+				}
+				return &TestBody{Msg: "checked out"}, nil
+			})
+			// places two orders at the same time, the calls are named to keep their keys
+			r.RegisterJson("POST", "/api/service/test/bulk-checkout", func(c *titan.Context, rq *TestBody) (*TestBody, error) {
+				errs := make(chan error, 2)
+				for i := 0; i < 2; i++ {
+					go func(call *titan.Context) {
+						request, _ := titan.NewReqBuilder().Post("/api/service/test/orders").BodyJSON(rq).Build()
+						_, err := client.SendRequest(call, request)
+						errs <- err
+					}(c.WithIdempotentCall(fmt.Sprintf("order-%d", i)))
+				}
+				for i := 0; i < 2; i++ {
+					if err := <-errs; err != nil {
+						return nil, err
+					}
+				}
+				if count("bulk-checkout") == 1 {
+					return nil, errors.New("payment error")
+				}
+				return &TestBody{Msg: "checked out"}, nil
+			})
+			r.RegisterJson("POST", "/api/service/test/slow-orders", func(c *titan.Context, rq *TestBody) (*TestBody, error) {
+				slowStarted <- struct{}{}
+				<-slowRelease
+				return &TestBody{Msg: "slow order"}, nil
+			})
+		}),
+		titan.Subscribe(func(ms *titan.MessageSubscriber) {
+			ms.Register("test.orders", "", func(m *titan.Message) error {
+				count("messages")
+				messageHandled <- struct{}{}
+				return nil
+			})
+		}),
+	)
+	testServer := test.NewTestServer(t, server)
+	testServer.Start()
+	defer testServer.Stop()
+
+	//2. a repeated request is answered with the first response
+	send := func(ctx *titan.Context, path, key string) (*titan.Response, error) {
+		request, _ := titan.NewReqBuilder().Post(path).IdempotencyKey(key).BodyJSON(TestBody{Msg: "order"}).Build()
+		return client.SendRequest(ctx, request)
+	}
+	user := &titan.UserInfo{UserId: "user-1", CareProviderId: "cp-1"}
+	userCtx := func() *titan.Context {
+		return titan.NewBackgroundContext().WithValue(titan.XUserInfo, user)
+	}
+	first, err := send(userCtx(), "/api/service/test/orders", "order-1")
+	require.NoError(t, err)
+	repeated, err := send(userCtx(), "/api/service/test/orders", "order-1")
+	require.NoError(t, err)
+	assert.Equal(t, string(first.Body), string(repeated.Body))
+	assert.Equal(t, "true", repeated.Headers.Get(titan.XIdempotentReplayed))
+	other, err := send(userCtx(), "/api/service/test/orders", "order-2")
+	require.NoError(t, err)
+	assert.NotEqual(t, string(first.Body), string(other.Body))
+
+	//3. the key of another user is another request, anonymous requests are not deduplicated
+	otherUserCtx := titan.NewBackgroundContext().WithValue(titan.XUserInfo, &titan.UserInfo{UserId: "user-2", CareProviderId: "cp-1"})
+	rp, err := send(otherUserCtx, "/api/service/test/orders", "order-1")
+	require.NoError(t, err)
+	assert.NotEqual(t, string(first.Body), string(rp.Body))
+	assert.Empty(t, rp.Headers.Get(titan.XIdempotentReplayed))
+	for i := 0; i < 2; i++ {
+		rp, err = send(titan.NewBackgroundContext(), "/api/service/test/orders", "order-1")
+		require.NoError(t, err)
+		assert.NotEqual(t, string(first.Body), string(rp.Body))
+		assert.Empty(t, rp.Headers.Get(titan.XIdempotentReplayed))
+	}
+
+	//4. distinct calls under the same key get their own keys, which the retried handler repeats
+	for _, path := range []string{"/api/service/test/checkout", "/api/service/test/bulk-checkout"} {
+		ordersBefore := counted("orders")
+		_, err = send(userCtx(), path, "checkout-1")
+		require.Error(t, err)
+		assert.Equal(t, ordersBefore+2, counted("orders"))
+		rp, err = send(userCtx(), path, "checkout-1")
+		require.NoError(t, err)
+		assert.Contains(t, string(rp.Body), "checked out")
+		assert.Equal(t, ordersBefore+2, counted("orders"))
+	}
+
+	//5. a repeated key is answered with 409 while the first request runs
+	slowResult := make(chan error, 1)
+	go func() {
+		_, err := send(userCtx(), "/api/service/test/slow-orders", "slow-1")
+		slowResult <- err
+	}()
+	<-slowStarted
+	_, err = send(userCtx(), "/api/service/test/slow-orders", "slow-1")
+	require.IsType(t, &titan.ClientResponseError{}, err)
+	assert.Equal(t, 409, err.(*titan.ClientResponseError).Response.StatusCode)
+	close(slowRelease)
+	require.NoError(t, <-slowResult)
+
+	//6. a repeated message is skipped even without a user, the key is derived from the key of the context
+	publish := func(key string) {
+		ctx := titan.NewBackgroundContext()
+		if key != "" {
+			ctx = titan.NewContext(context.WithValue(context.Background(), titan.XIdempotencyKey, key))
+		}
+		require.NoError(t, client.Publish(ctx, "test.orders", TestBody{Msg: "order"}))
+	}
+	publish("message-1")
+	<-messageHandled
+	publish("message-1")
+	publish("")
+	<-messageHandled
+	assert.Equal(t, 2, counted("messages"))
+}
@@ -0,0 +1,409 @@
+package titan
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"logur.dev/logur"
+)
+
+// size of the chunks a streamed body is split into, far below the NATS max payload
+const streamChunkSize = 64 * 1024
+
+// chunks a streaming server sends ahead of the acknowledgements of the client, a slow client
+// holds back the server instead of missing chunks
+const streamWindow = 8
+
+// StreamFunc writes a response body of unknown size, see ResponseBuilder.Stream
+type StreamFunc func(w io.Writer) error
+
+// ResponseStream is a response whose body is read while the server is still writing it.
+type ResponseStream struct {
+	Status     string
+	StatusCode int
+	Headers    http.Header
+	Body       io.ReadCloser
+}
+
+// chunkWriter buffers writes into chunks and flushes every chunk to the underlying writer,
+// the http server sends each of them with chunked transfer encoding.
+type chunkWriter struct {
+	w   http.ResponseWriter
+	buf []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		free := streamChunkSize - len(c.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		c.buf = append(c.buf, p[:free]...)
+		p = p[free:]
+		if len(c.buf) == streamChunkSize {
+			if err := c.Flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (c *chunkWriter) Flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	_, err := c.w.Write(c.buf)
+	c.buf = c.buf[:0]
+	if err != nil {
+		return err
+	}
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// ------------------------ NATS server side ------------------------------------
+
+// streamWriter is the http.ResponseWriter of requests sent with the X-Stream header,
+// every write is published as an ordered chunk to the reply inbox.
+// Clients sending X-Stream-Window acknowledge every chunk they read, the writer waits for them
+// once that many chunks are unacknowledged.
+type streamWriter struct {
+	ctx         context.Context
+	enc         *nats.EncodedConn
+	rpSubject   string
+	headers     http.Header
+	statusCode  int
+	seq         int
+	wroteHeader bool
+	window      int
+	acked       int
+	ackSub      *nats.Subscription // nil for clients without flow control
+	err         error              // the client is gone, nothing is sent anymore
+}
+
+func newStreamWriter(ctx context.Context, enc *nats.EncodedConn, rpSubject string, window int) (*streamWriter, error) {
+	s := &streamWriter{ctx: ctx, enc: enc, rpSubject: rpSubject, headers: http.Header{}, window: window}
+	if window > 0 {
+		sub, err := enc.Conn.SubscribeSync(nats.NewInbox())
+		if err != nil {
+			return nil, errors.WithMessage(err, "nats stream ack subscription error")
+		}
+		s.ackSub = sub
+	}
+	return s, nil
+}
+
+func (s *streamWriter) Header() http.Header {
+	return s.headers
+}
+
+func (s *streamWriter) WriteHeader(code int) {
+	if s.statusCode == 0 {
+		s.statusCode = code
+	}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		size := streamChunkSize
+		if size > len(p) {
+			size = len(p)
+		}
+		if err := s.publish(p[:size], nil); err != nil {
+			return n - len(p), err
+		}
+		p = p[size:]
+	}
+	return n, nil
+}
+
+func (s *streamWriter) Flush() {}
+
+// Close publishes the end of stream marker
+func (s *streamWriter) Close() error {
+	if s.ackSub != nil {
+		defer func() { _ = s.ackSub.Unsubscribe() }()
+	}
+	end := http.Header{}
+	end.Set(XStreamEnd, "true")
+	return s.publish(nil, end)
+}
+
+// waitCredit waits until less than window chunks are unacknowledged
+func (s *streamWriter) waitCredit() error {
+	for s.err == nil && s.ackSub != nil && s.seq-s.acked >= s.window {
+		ack, err := nextResponse(s.ctx, s.enc, s.ackSub)
+		if err != nil {
+			s.err = errors.WithMessage(err, "nats stream acknowledgement error")
+		} else if msg := ack.Headers.Get(XStreamError); msg != "" {
+			s.err = errors.New("nats stream closed by the client: " + msg)
+		} else {
+			s.acked++
+		}
+	}
+	return s.err
+}
+
+func (s *streamWriter) publish(body []byte, headers http.Header) error {
+	if err := s.waitCredit(); err != nil {
+		return err
+	}
+	rp := &Response{Headers: headers, Body: body}
+	if !s.wroteHeader {
+		s.wroteHeader = true
+		if s.statusCode == 0 {
+			s.statusCode = http.StatusOK
+		}
+		rp.StatusCode = s.statusCode
+		rp.Headers = s.headers
+		rp.Headers.Set(XResponeTime, strconv.FormatInt(time.Now().UnixNano(), 10))
+		rp.Headers.Set(XHostname, hostname)
+		for k, v := range headers {
+			rp.Headers[k] = v
+		}
+	}
+	if rp.Headers == nil {
+		rp.Headers = http.Header{}
+	}
+	rp.Headers.Set(XStreamSeq, strconv.Itoa(s.seq))
+	s.seq++
+	if s.ackSub != nil {
+		return s.enc.PublishRequest(s.rpSubject, s.ackSub.Subject, rp)
+	}
+	return s.enc.Publish(s.rpSubject, rp)
+}
+
+// newTimeoutHandler is http.TimeoutHandler for plain requests, streamed responses are not buffered
+// by it but bound by a context deadline instead.
+func newTimeoutHandler(h http.Handler, timeout time.Duration, msg string) http.Handler {
+	buffered := http.TimeoutHandler(h, timeout, msg)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the stream writer may be wrapped by middlewares already, the header tells it apart
+		if r.Header.Get(XStream) != "" {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			h.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		buffered.ServeHTTP(w, r)
+	})
+}
+
+// ------------------------ NATS client side ------------------------------------
+
+// SendStreamRequest sends the request with a unique inbox and returns as soon as the first chunk arrives.
+func (c *Connection) SendStreamRequest(ctx context.Context, rq *Request, subject string) (*ResponseStream, error) {
+	if subject == "" {
+		return nil, errors.New("nats subject cannot be nil")
+	}
+	inbox := nats.NewInbox()
+	sub, err := c.Conn.Conn.SubscribeSync(inbox)
+	if err != nil {
+		return nil, errors.WithMessage(err, "nats inbox subscription error")
+	}
+
+	rq.Headers.Set(XStream, "true")
+	rq.Headers.Set(XStreamWindow, strconv.Itoa(streamWindow))
+	msg, err := encodeMsg(c.Conn, subject, inbox, rq, rq.Headers)
+	if err == nil {
+		err = c.Conn.Conn.PublishMsg(msg)
+	}
+	if err != nil {
+		_ = sub.Unsubscribe()
+		return nil, errors.WithMessage(err, "nats stream publish error")
+	}
+
+	reader := &natsStreamReader{ctx: ctx, enc: c.Conn, sub: sub}
+	first, err := reader.next()
+	if err != nil {
+		_ = sub.Unsubscribe()
+		return nil, err
+	}
+
+	return &ResponseStream{
+		Status:     first.Status,
+		StatusCode: first.StatusCode,
+		Headers:    first.Headers,
+		Body:       reader,
+	}, nil
+}
+
+type natsStreamReader struct {
+	ctx  context.Context
+	enc  *nats.EncodedConn
+	sub  *nats.Subscription
+	buf  []byte
+	seq  int
+	err  error // error which ended the stream early
+	done bool
+	ack  string // inbox of the server acknowledgements, empty for servers without flow control
+}
+
+// nextMsg waits for the next message until ctx is done, without a deadline on ctx it waits Nats.ReadTimeout
+func nextMsg(ctx context.Context, sub *nats.Subscription) (*nats.Msg, error) {
+	var msg *nats.Msg
+	var err error
+	if _, ok := ctx.Deadline(); ok {
+		msg, err = sub.NextMsgWithContext(ctx)
+	} else {
+		msg, err = sub.NextMsg(GetNatsConfig().GetReadTimeoutDuration() + 5*time.Second)
+	}
+	if err == nats.ErrTimeout || err == context.DeadlineExceeded {
+		return nil, nats.ErrTimeout
+	}
+	return msg, err
+}
+
+// nextResponse waits for the next response published to the inbox subscription
+func nextResponse(ctx context.Context, enc *nats.EncodedConn, sub *nats.Subscription) (*Response, error) {
+	rp, _, err := nextResponseMsg(ctx, enc, sub)
+	return rp, err
+}
+
+// nextResponseMsg waits for the next response and returns the reply subject it came with
+func nextResponseMsg(ctx context.Context, enc *nats.EncodedConn, sub *nats.Subscription) (*Response, string, error) {
+	msg, err := nextMsg(ctx, sub)
+	if err != nil {
+		return nil, "", err
+	}
+	rp := &Response{}
+	if err := enc.Enc.Decode(msg.Subject, msg.Data, rp); err != nil {
+		return nil, "", errors.WithMessage(err, "nats response decoding error")
+	}
+	if rp.Headers == nil {
+		rp.Headers = http.Header{}
+	}
+	return rp, msg.Reply, nil
+}
+
+// next reads the next chunk, reading it gives the server credit for one more
+func (r *natsStreamReader) next() (*Response, error) {
+	rp, ack, err := nextResponseMsg(r.ctx, r.enc, r.sub)
+	if err != nil {
+		return nil, err
+	}
+	if ack != "" {
+		r.ack = ack
+		if err := r.enc.Publish(ack, &Response{StatusCode: http.StatusOK}); err != nil {
+			return nil, errors.WithMessage(err, "nats stream acknowledgement error")
+		}
+	}
+
+	seq := rp.Headers.Get(XStreamSeq)
+	if seq == "" {
+		// plain reply, e.g. from a server without streaming support or an error reply
+		if r.seq > 0 {
+			return nil, errors.New("nats stream aborted by the server")
+		}
+		r.done = true
+		r.buf = rp.Body
+		return rp, nil
+	}
+	if seq != strconv.Itoa(r.seq) {
+		return nil, errors.Errorf("nats stream chunk out of order, expected %d got %s", r.seq, seq)
+	}
+	r.seq++
+	r.buf = rp.Body
+	r.done = rp.Headers.Get(XStreamEnd) != ""
+	return rp, nil
+}
+
+func (r *natsStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			if r.err != nil {
+				return 0, r.err
+			}
+			return 0, io.EOF
+		}
+		if _, err := r.next(); err != nil {
+			r.done, r.err = true, err
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close stops the stream, a server waiting for credit is told the client is gone
+func (r *natsStreamReader) Close() error {
+	if !r.done && r.ack != "" {
+		closed := &Response{StatusCode: http.StatusOK, Headers: http.Header{}}
+		closed.Headers.Set(XStreamError, "body closed")
+		_ = r.enc.Publish(r.ack, closed)
+	}
+	return r.sub.Unsubscribe()
+}
+
+// ------------------------ Client ------------------------------------
+
+// SendStreamRequest sends the request and returns the response body as a stream,
+// the caller must close the body.
+func (srv *Client) SendStreamRequest(ctx *Context, rq *Request) (*ResponseStream, error) {
+	logger := ctx.Logger()
+	requestId := setRequestHeaders(ctx, rq)
+
+	var reqCtx context.Context = ctx
+	cancel := func() {}
+	if rq.Timeout > 0 {
+		reqCtx, cancel = context.WithTimeout(ctx, rq.Timeout)
+	}
+	setRequestTimeout(reqCtx, rq)
+	rq.Headers.Set(UberTraceID, ctx.UberTraceID())
+
+	subject := rq.Subject
+	if rq.Subject == "" {
+		subject = Url2Subject(rq.URL)
+	}
+
+	logger.Debug("Nats client sending stream request to", map[string]interface{}{"url": rq.URL, "id": requestId, "method": rq.Method})
+	var stream *ResponseStream
+	err := errNotSupported(srv.conn, "stream requests")
+	if s, ok := srv.conn.(StreamRequester); ok {
+		stream, err = s.SendStreamRequest(reqCtx, rq, subject)
+	}
+	if err != nil {
+		cancel()
+		return nil, transportError(requestId, err)
+	}
+
+	// the request timeout lasts until the body is closed
+	stream.Body = &cancelOnClose{ReadCloser: stream.Body, cancel: cancel}
+
+	if stream.StatusCode >= 300 || stream.StatusCode < 200 {
+		return nil, streamError(logger, stream)
+	}
+	return stream, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// streamError reads the error body of a failed stream into a ClientResponseError
+func streamError(logger logur.Logger, stream *ResponseStream) error {
+	defer func() { _ = stream.Body.Close() }()
+	body, err := ioutil.ReadAll(stream.Body)
+	if err != nil {
+		logger.Error("reading stream error body failed", map[string]interface{}{"err": err.Error()})
+	}
+	return statusError(&Response{Status: stream.Status, StatusCode: stream.StatusCode, Headers: stream.Headers, Body: body})
+}
@@ -0,0 +1,55 @@
+package titan
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// subjectTemplate is a subject pattern with named tokens, e.g. events.careprovider.{cpId}.patient.>
+// Named tokens match a single token like '*'.
+type subjectTemplate struct {
+	pattern string         // NATS subject pattern
+	names   map[int]string // token names by position
+}
+
+// parseSubjectTemplate returns an error for unnamed tokens `{}` and names used twice
+func parseSubjectTemplate(template string) (subjectTemplate, error) {
+	t := subjectTemplate{pattern: template}
+	tokens := strings.Split(template, ".")
+	seen := map[string]bool{}
+	for i, token := range tokens {
+		if strings.HasPrefix(token, "{") && strings.HasSuffix(token, "}") {
+			name := token[1 : len(token)-1]
+			if name == "" {
+				return t, errors.Errorf("subject template %s has an unnamed token", template)
+			}
+			if seen[name] {
+				return t, errors.Errorf("subject template %s uses the token name %s twice", template, name)
+			}
+			seen[name] = true
+			if t.names == nil {
+				t.names = map[int]string{}
+			}
+			t.names[i] = name
+			tokens[i] = "*"
+		}
+	}
+	t.pattern = strings.Join(tokens, ".")
+	return t, nil
+}
+
+// params extracts the named tokens of the subject, nil for templates without names
+func (t subjectTemplate) params(subject string) SubjectParams {
+	if t.names == nil {
+		return nil
+	}
+	tokens := strings.Split(subject, ".")
+	params := SubjectParams{}
+	for i, name := range t.names {
+		if i < len(tokens) {
+			params[name] = tokens[i]
+		}
+	}
+	return params
+}
@@ -0,0 +1,61 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/pkg/errors"
+
+	"gitlab.com/silenteer-oss/titan"
+)
+
+// EmbeddedNats is an in-process NATS server listening on a random local port.
+type EmbeddedNats struct {
+	server   *server.Server
+	storeDir string
+}
+
+// NewEmbeddedNats starts an in-process NATS server with JetStream and wires it into titan,
+// so NewServer and GetDefaultClient connect to it instead of Nats.Servers.
+func NewEmbeddedNats() (*EmbeddedNats, error) {
+	storeDir, err := ioutil.TempDir("", "titan-jetstream")
+	if err != nil {
+		return nil, errors.WithMessage(err, "Embedded nats store dir error")
+	}
+
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  storeDir,
+	})
+	if err != nil {
+		_ = os.RemoveAll(storeDir)
+		return nil, errors.WithMessage(err, "Embedded nats creation error")
+	}
+
+	go s.Start()
+
+	if !s.ReadyForConnections(10 * time.Second) {
+		s.Shutdown()
+		_ = os.RemoveAll(storeDir)
+		return nil, errors.New("Embedded nats is not ready for connections")
+	}
+
+	titan.SetNatsServers(s.ClientURL())
+
+	return &EmbeddedNats{server: s, storeDir: storeDir}, nil
+}
+
+func (e *EmbeddedNats) ClientURL() string {
+	return e.server.ClientURL()
+}
+
+func (e *EmbeddedNats) Shutdown() {
+	e.server.Shutdown()
+	_ = os.RemoveAll(e.storeDir)
+}
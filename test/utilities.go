@@ -2,6 +2,8 @@ package test
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -60,6 +62,16 @@ func (wg *TestWaitGroup) WaitOrTimeoutForWithMessage(timeout int, timeoutMessage
 	WaitOrTimeoutFor(wg.t, wg.done, timeout, timeoutMessage)
 }
 
+// FreePort returns a local port nothing listens on right now
+func FreePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Free port error: %+v", err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
 func WaitOrTimeout(t *testing.T, ch chan interface{}, msg string) {
 	WaitOrTimeoutFor(t, ch, 1, msg)
 }
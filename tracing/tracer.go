@@ -62,7 +62,7 @@ func initTracing(serviceName string) opentracing.Tracer {
 		return nil
 	}
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func(close io.Closer) {
 		<-c
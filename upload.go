@@ -0,0 +1,288 @@
+package titan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// Upload protocol: the client sends the request with the X-Upload header and no body,
+// the server answers 100 Continue with the inbox to stream the body to in X-Upload-Inbox.
+// The client then sends the body as ordered Message chunks, every chunk is acknowledged by the server
+// once the handler consumed it, and the last chunk carries X-Stream-End.
+// The final response is published to the reply inbox of the request.
+
+// ------------------------ NATS server side ------------------------------------
+
+// uploadReader is the http request body of an upload, it reads the chunks sent to its inbox.
+type uploadReader struct {
+	ctx  context.Context
+	enc  *nats.EncodedConn
+	sub  *nats.Subscription
+	buf  []byte
+	seq  int
+	err  error
+	done bool
+}
+
+// newUploadReader subscribes a new inbox and asks the client to send the body to it
+func newUploadReader(ctx context.Context, enc *nats.EncodedConn, rpSubject string) (*uploadReader, error) {
+	inbox := nats.NewInbox()
+	sub, err := enc.Conn.SubscribeSync(inbox)
+	if err != nil {
+		return nil, errors.WithMessage(err, "nats upload inbox subscription error")
+	}
+
+	rp := &Response{StatusCode: http.StatusContinue, Headers: http.Header{}}
+	rp.Headers.Set(XUploadInbox, inbox)
+	if err := enc.Publish(rpSubject, rp); err != nil {
+		_ = sub.Unsubscribe()
+		return nil, errors.WithMessage(err, "nats upload continue error")
+	}
+
+	return &uploadReader{ctx: ctx, enc: enc, sub: sub}, nil
+}
+
+func (r *uploadReader) next() error {
+	msg, err := nextMsg(r.ctx, r.sub)
+	if err != nil {
+		return err
+	}
+	var chunk Message
+	if err := r.enc.Enc.Decode(msg.Subject, msg.Data, &chunk); err != nil {
+		return errors.WithMessage(err, "nats upload chunk decoding error")
+	}
+	if chunk.Headers == nil {
+		chunk.Headers = http.Header{}
+	}
+
+	if seq := chunk.Headers.Get(XStreamSeq); seq != strconv.Itoa(r.seq) {
+		return errors.Errorf("nats upload chunk out of order, expected %d got %s", r.seq, seq)
+	}
+	if msg := chunk.Headers.Get(XStreamError); msg != "" {
+		return errors.New("nats upload aborted by the client: " + msg)
+	}
+	r.seq++
+	r.buf = chunk.Body
+	r.done = chunk.Headers.Get(XStreamEnd) != ""
+
+	// acknowledge, the client sends the next chunk
+	return r.enc.Publish(msg.Reply, &Response{StatusCode: http.StatusOK})
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *uploadReader) Close() error {
+	return r.sub.Unsubscribe()
+}
+
+// ------------------------ NATS client side ------------------------------------
+
+// SendUploadRequest sends the request and streams body to the server in acknowledged chunks.
+func (c *Connection) SendUploadRequest(ctx context.Context, rq *Request, subject string, body io.Reader) (*Response, error) {
+	if subject == "" {
+		return nil, errors.New("nats subject cannot be nil")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, GetNatsConfig().GetReadTimeoutDuration()+5*time.Second)
+		defer cancel()
+	}
+
+	// replies and chunk acknowledgements arrive on the same channel, so that a handler
+	// answering before it consumed the whole body does not leave the client waiting for an ack
+	msgs := make(chan *nats.Msg, 16)
+	inbox := nats.NewInbox()
+	ackInbox := nats.NewInbox()
+	for _, subj := range []string{inbox, ackInbox} {
+		sub, err := c.Conn.Conn.ChanSubscribe(subj, msgs)
+		if err != nil {
+			return nil, errors.WithMessage(err, "nats inbox subscription error")
+		}
+		defer func(sub *nats.Subscription) { _ = sub.Unsubscribe() }(sub)
+	}
+
+	next := func() (*nats.Msg, error) {
+		select {
+		case msg := <-msgs:
+			return msg, nil
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, nats.ErrTimeout
+			}
+			return nil, ctx.Err()
+		}
+	}
+	decode := func(msg *nats.Msg) (*Response, error) {
+		rp := &Response{}
+		if err := c.Conn.Enc.Decode(msg.Subject, msg.Data, rp); err != nil {
+			return nil, errors.WithMessage(err, "nats response decoding error")
+		}
+		if rp.Headers == nil {
+			rp.Headers = http.Header{}
+		}
+		return rp, nil
+	}
+
+	rq.Headers.Set(XUpload, "true")
+	rq.Body = nil
+	msg, err := encodeMsg(c.Conn, subject, inbox, rq, rq.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Conn.Conn.PublishMsg(msg); err != nil {
+		return nil, errors.WithMessage(err, "nats upload publish error")
+	}
+
+	msg, err = next()
+	if err != nil {
+		return nil, err
+	}
+	rp, err := decode(msg)
+	if err != nil || rp.StatusCode != http.StatusContinue {
+		// the server does not accept uploads or failed already
+		return rp, err
+	}
+	uploadInbox := rp.Headers.Get(XUploadInbox)
+
+	buf := make([]byte, streamChunkSize)
+	for seq := 0; ; seq++ {
+		chunk := &Message{Headers: http.Header{}}
+		chunk.Headers.Set(XStreamSeq, strconv.Itoa(seq))
+
+		n, rerr := io.ReadFull(body, buf)
+		chunk.Body = buf[:n]
+		switch rerr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			chunk.Headers.Set(XStreamEnd, "true")
+		default:
+			chunk.Headers.Set(XStreamError, rerr.Error())
+		}
+
+		if err := c.Conn.PublishRequest(uploadInbox, ackInbox, chunk); err != nil {
+			return nil, errors.WithMessage(err, "nats upload chunk error")
+		}
+		if chunk.Headers.Get(XStreamError) != "" {
+			return nil, errors.WithMessage(rerr, "reading upload body error")
+		}
+
+		msg, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if msg.Subject == inbox {
+			// the handler answered before it consumed the whole body
+			return decode(msg)
+		}
+		if chunk.Headers.Get(XStreamEnd) != "" {
+			break
+		}
+	}
+
+	for {
+		msg, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if msg.Subject == inbox {
+			return decode(msg)
+		}
+	}
+}
+
+// ------------------------ Client ------------------------------------
+
+// SendUploadRequest sends the request and streams body to the server instead of sending rq.Body,
+// the server handler reads it as a normal request body. Uploads are never retried.
+func (srv *Client) SendUploadRequest(ctx *Context, rq *Request, body io.Reader) (*Response, error) {
+	logger := ctx.Logger()
+	requestId := setRequestHeaders(ctx, rq)
+
+	var reqCtx context.Context = ctx
+	if rq.Timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, rq.Timeout)
+		defer cancel()
+	}
+	setRequestTimeout(reqCtx, rq)
+	rq.Headers.Set(UberTraceID, ctx.UberTraceID())
+
+	subject := rq.Subject
+	if rq.Subject == "" {
+		subject = Url2Subject(rq.URL)
+	}
+
+	logger.Debug("Nats client sending upload request to", map[string]interface{}{"url": rq.URL, "id": requestId, "method": rq.Method})
+	var rp *Response
+	err := errNotSupported(srv.conn, "upload requests")
+	if u, ok := srv.conn.(UploadRequester); ok {
+		rp, err = u.SendUploadRequest(reqCtx, rq, subject, body)
+	}
+	if err != nil {
+		return nil, transportError(requestId, err)
+	}
+	if rp.Headers == nil {
+		rp.Headers = http.Header{}
+	}
+	if err := statusError(rp); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// bodies up to this size are forwarded in the request, larger ones or those of unknown size are uploaded in chunks
+const forwardUploadThreshold = 256 * 1024
+
+// ForwardHandler relays http requests to the NATS service of their url, e.g. in an API gateway.
+// Large bodies are streamed to the service with SendUploadRequest instead of being read into memory.
+func ForwardHandler(client *Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := NewContext(r.Context())
+		defer func() { _ = r.Body.Close() }()
+
+		rq := &Request{URL: r.URL.RequestURI(), Method: r.Method, Headers: r.Header.Clone()}
+		var rp *Response
+		var err error
+		if r.ContentLength >= 0 && r.ContentLength <= forwardUploadThreshold {
+			rq.Body, err = ioutil.ReadAll(r.Body)
+			if err == nil {
+				rp, err = client.SendRequest(ctx, rq)
+			}
+		} else {
+			rp, err = client.SendUploadRequest(ctx, rq, r.Body)
+		}
+
+		if err != nil {
+			if clientErr, ok := err.(*ClientResponseError); ok && clientErr.Response != nil {
+				rp = clientErr.Response
+			} else {
+				ctx.Logger().Error(fmt.Sprintf("forwarding request error: %+v\n ", err))
+				rp = createInternalErrorResponse(ctx.RequestId(), rq.URL, err)
+			}
+		}
+		if err := writeResponse(w, rp); err != nil {
+			ctx.Logger().Error(fmt.Sprintf("forwarded response writing error: %+v\n ", err))
+		}
+	})
+}